@@ -1,3 +1,5 @@
 module github.com/3tagger/go-module-udemy/v2
 
-go 1.18
+go 1.20
+
+require golang.org/x/text v0.14.0
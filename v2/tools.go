@@ -1,317 +1,5319 @@
 package toolkit
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 const defaultMaxFileSize = 1024 * 1024 // 1 MB
 const defaultMaxJSONSize = 1024 * 1024 // 1 MB
+const defaultShutdownTimeout = 10 * time.Second
+const defaultMinUploadSpeedWindow = 5 * time.Second
+const defaultMaxFileNameLength = 255 // bytes, the limit of most filesystems
+const defaultMaxDecodePixels = 50_000_000
 const randomStringSource = "abcdefghijklmnopqrstuvwyzABCDEFGHIJKLMNOPQRSTUVWXYZ01234567889"
 
 // Tools is the type used to instantiate this module.
 // Any variable of this type will have access to all the methods with the receiver *Tools
 type Tools struct {
-	MaxFileSize        int64
-	AllowedFileTypes   []string
-	MaxJSONSize        int64
-	AllowUnknownFields bool
+	MaxFileSize int64
+	// MaxFileSizeByType overrides MaxFileSize for the files of the detected content types
+	// it lists, which may wildcard the subtype like "image/*". An exact type wins over a
+	// wildcard. Files of types without an entry are limited by MaxFileSize
+	MaxFileSizeByType map[string]int64
+	// MinFileSize rejects uploaded files smaller than it with ErrFileTooSmall. Empty files
+	// are always rejected
+	MinFileSize int64
+	// AllowedFileTypes lists the detected content types accepted by the upload helpers.
+	// Entries may wildcard the subtype, like "image/*" or "application/*+json".
+	// When it, AllowedFileExtensions and DisallowedFileTypes are all empty every upload is rejected
+	AllowedFileTypes []string
+	// DisallowedFileTypes lists detected content types, with the same syntax as AllowedFileTypes,
+	// which are always rejected, even when they are also allowed
+	DisallowedFileTypes []string
+	// AllowedFileExtensions lists the extensions, like ".pdf", accepted by the upload helpers
+	// in addition to AllowedFileTypes. A file must pass both lists when both are set
+	AllowedFileExtensions []string
+	MaxJSONSize           int64
+	AllowUnknownFields    bool
+	// APIVersion, when set, is injected into every JSONResponse written by WriteJSON
+	APIVersion string
+	// ShutdownTimeout is how long ServeAndShutdown waits for in-flight requests, defaults to 10 seconds
+	ShutdownTimeout time.Duration
+	// TimeFormat is the layout used by FormatTime, TimeFormatUnix emits seconds since epoch
+	TimeFormat string
+	// MaxConcurrentUploads caps how many files UploadFiles writes to disk at the same time,
+	// across all requests sharing this Tools, and copies of it made after the first upload.
+	// Zero means unlimited. A change applies to the files started after it
+	MaxConcurrentUploads int
+
+	// MinUploadSpeed aborts an upload whose throughput, in bytes per second, drops below it
+	// over the last MinUploadSpeedWindow, a sliding window, which includes a client sending
+	// nothing at all. The first window is always allowed. Zero disables the check
+	MinUploadSpeed       int64
+	MinUploadSpeedWindow time.Duration
+
+	// DevMode makes WriteJSON and ErrorJSON pretty print their output
+	DevMode bool
+	// JSONIndent, when set, is used by WriteJSON to indent every response
+	JSONIndent string
+	// DefaultResponseHeaders are added to every response written by WriteJSON and ErrorJSON
+	DefaultResponseHeaders http.Header
+	// AllowTrailingData makes ReadJSON decode the first JSON value and ignore anything after it
+	AllowTrailingData bool
+	// RequestSizeLimit, when set, is the body size limit used by both MaxBytesMiddleware and
+	// ReadJSON, taking precedence over MaxJSONSize
+	RequestSizeLimit int64
+	// WebhookSecret, when set, makes WriteJSON sign every body with HMAC-SHA256 so receivers
+	// can authenticate it. The signature is sent as X-Webhook-Signature: sha256=<hex>
+	WebhookSecret string
+	// DeepMergeJSON makes MergeJSON merge nested objects instead of replacing them
+	DeepMergeJSON bool
+	// RequiredAspectRatio, when set, rejects uploaded images with a different width:height ratio
+	RequiredAspectRatio *AspectRatio
+	// MaxImageWidth and MaxImageHeight, when set, reject uploaded images larger than them
+	// with ErrImageTooLarge. Only png, jpeg and gif headers are decoded, other files aren't checked
+	MaxImageWidth  int
+	MaxImageHeight int
+	// MaxDecodePixels caps the width times height of the images decoded to write thumbnails
+	// or convert them, which takes 4 bytes of memory per pixel, defaults to 50 million.
+	// A larger image isn't converted but rejected with ErrImageTooLarge, and gets no thumbnail
+	MaxDecodePixels int64
+	// Thumbnail, when set, makes the upload helpers write a thumbnail next to every uploaded
+	// image. Failing to write it doesn't fail the upload, see UploadedFile.ThumbnailErr
+	Thumbnail *ThumbnailSpec
+	// StripEXIF removes the EXIF and XMP metadata, the APP1 segments, of uploaded JPEGs
+	// before they are saved
+	StripEXIF bool
+	// ConvertImagesTo, when set to "jpeg" or "png", makes the upload helpers re-encode every
+	// uploaded image to that format, changing its extension and content type. JPEGs are written
+	// at quality 85 with transparency flattened onto white, and only the first frame of an
+	// animated GIF is kept. Images which can't be decoded fail with an *ImageConversionError
+	ConvertImagesTo string
+	// Storage, when set, is where the upload helpers write the files which passed every
+	// check, instead of the upload directory, which is then ignored. Names are only checked
+	// for collisions by the storage, and FullPath and thumbnails are left out
+	Storage FileStorage
+	// UploadScanner, when set, is given the content of every uploaded file while it is
+	// written, and a file it returns an error for is not kept
+	UploadScanner UploadScanner
+	// DeduplicateUploads makes the upload helpers keep a single copy of identical files saved
+	// on disk. Checksums are kept in an index file, named .upload-index.json, in the upload
+	// directory, and uploading content already in it returns the first file marked Duplicate
+	// without writing the content again
+	DeduplicateUploads bool
+	// UploadConcurrency is how many files of a request are validated and saved at the same
+	// time, defaults to 1. Above 1 the files of a streamed form are copied to temporary files
+	// until it is received, and OnUploadProgress may be called concurrently. The files are
+	// still returned in order, and a failure is reported like with a single worker. Names
+	// given by DuplicateSuffix and CollisionAutoSuffix go to the files in the order they are
+	// checked, which may not be the order of the form
+	UploadConcurrency int
+	// CopyBufferSize is the size of the buffers uploaded files are written to disk with,
+	// defaults to 256 KB. Buffers are pooled and reused across uploads
+	CopyBufferSize int
+	// MarshalFunc is used by PushJSONToRemote to serialize data, defaults to json.Marshal
+	MarshalFunc func(v interface{}) ([]byte, error)
+	// PushRequireSuccess makes PushJSONToRemote return a RemoteError of kind RemoteErrorStatus,
+	// instead of the response, when the remote service doesn't respond with a 2xx status
+	PushRequireSuccess bool
+	// DuplicateFileNames decides what happens to files of one request sharing a name
+	DuplicateFileNames DuplicatePolicy
+	// CollisionPolicy decides what happens to uploads named like a file already saved
+	// in the upload directory, by this request or an earlier one
+	CollisionPolicy CollisionPolicy
+	// SlugStopWords are whole words removed, case-insensitively, by Slugify
+	SlugStopWords []string
+	// PublicBaseURL is the URL the upload directory is served from, used to fill UploadedFile.URL.
+	// Files saved in a directory chosen by UploadDirFunc get no URL
+	PublicBaseURL string
+	// ValidatePDFs checks that uploaded PDFs start with %PDF- and end with %%EOF
+	ValidatePDFs bool
+	// RejectEncryptedPDFs additionally rejects PDFs containing an /Encrypt dictionary
+	RejectEncryptedPDFs bool
+	// MaxFileNameLength is the maximum length in bytes of a saved file name, defaults to 255
+	MaxFileNameLength int
+	// TruncateLongFileNames shortens names longer than MaxFileNameLength, keeping their
+	// extension, instead of rejecting the file
+	TruncateLongFileNames bool
+	// InferAllowedExtensions rejects uploads whose extension isn't one ExtensionContentTypes
+	// or the mime package associates with any of the AllowedFileTypes
+	InferAllowedExtensions bool
+
+	// RandSource is the source of randomness of RandomString and GenerateTOTPSecret, defaults
+	// to crypto/rand.Reader. It is meant for deterministic tests, production code must use
+	// a cryptographically secure source. RandomString falls back to crypto/rand.Reader when
+	// it returns an error
+	RandSource io.Reader
+
+	// Metrics, when set, receives byte counts, durations and errors of UploadFiles,
+	// ReadJSON, WriteJSON and PushJSONToRemote
+	Metrics Metrics
+
+	// MaxUploadCount is the maximum number of files accepted in a single upload request,
+	// requests with more are rejected with ErrTooManyFiles. Zero means unlimited
+	MaxUploadCount int
+
+	// UploadDirFunc, when set, is called by UploadFiles for each file with the request, the
+	// form field and the detected content type of the file, and returns the directory the
+	// file is saved in instead of the upload directory. The directory is created when
+	// missing, and an error rejects the file. It is only used when files are saved on disk,
+	// and MaxDirBytes counts all the files of a request against each directory. PublicBaseURL
+	// doesn't apply to these files, their URL is left empty
+	UploadDirFunc func(r *http.Request, fieldName, detectedType string) (string, error)
+
+	// FileNameValidator, when set, is called with the name a file keeps when it isn't renamed,
+	// once sanitized and shortened to MaxFileNameLength, and rejects the file when it returns
+	// an error. It isn't called for renamed files
+	FileNameValidator func(name string) error
+
+	// StrictContentType makes UploadFiles also check the Content-Type the client declared for
+	// each file part: it must be set, be the detected content type and be in AllowedFileTypes
+	StrictContentType bool
+
+	// RequireExtensionMatch rejects uploads whose extension doesn't match their detected
+	// content type, according to ExtensionContentTypes and the mime package
+	RequireExtensionMatch bool
+	// ExtensionContentTypes registers extra extension to content type pairs, like
+	// ".heic": "image/heic", used by RequireExtensionMatch and InferAllowedExtensions.
+	// Entries override the types registered in the mime package
+	ExtensionContentTypes map[string]string
+
+	// RenameFunc, when set, derives the name of renamed uploads from their original name instead
+	// of using random characters. Path separators in its result are replaced, and an empty
+	// result falls back to the random name
+	RenameFunc func(originalName string) string
+	// RenameStrategy decides how renamed uploads are named, defaults to RenameRandom
+	RenameStrategy RenameStrategy
+
+	// UploadFieldName, when set, restricts UploadFiles, UploadFilesWithSummary and
+	// UploadFilesStreaming to the files of that form field, the others are ignored
+	UploadFieldName string
+	// RejectUnexpectedUploadFields rejects requests with files outside of UploadFieldName
+	// with ErrUnexpectedUploadField instead of ignoring them
+	RejectUnexpectedUploadFields bool
+
+	// ContinueOnUploadError makes UploadFiles skip the files it fails to save instead of
+	// stopping, returning the saved files along an UploadErrors describing each failure
+	ContinueOnUploadError bool
+
+	// UploadFileMode is the permission of saved uploads before the umask, defaults to 0666
+	UploadFileMode os.FileMode
+
+	// UploadPathLayout, when set, is a time layout like "2006/01/02" naming the subdirectory
+	// of the upload directory files are saved in, based on the time of the upload
+	UploadPathLayout string
+	// ShardUploads is the number of two character subdirectory levels, taken from the SHA-256
+	// of the saved file name, files are spread across, like ab/cd/name.png for 2. They
+	// come after the UploadPathLayout subdirectory. Zero disables sharding
+	ShardUploads int
+
+	// OnUploadProgress, when set, is called by the upload helpers each time a chunk of a file
+	// is written, with the bytes copied so far and the size of the file, or -1 when it isn't
+	// known beforehand as with UploadFiles. A panic in it is recovered and ignored
+	OnUploadProgress func(fileName string, copied, total int64)
+
+	// OnFileUploaded, when set, is called by the upload helpers with each file as soon as it
+	// is saved, with all of its fields set. When it returns an error the file is removed
+	// and the error is the upload error of the file
+	OnFileUploaded func(f *UploadedFile) error
+
+	// MaxTotalUploadSize caps the bytes of all the files of one request together. Once it
+	// is exceeded UploadFiles stops and returns a TotalSizeExceededError, removing the files
+	// it already saved since the request is rejected as a whole. Zero means unlimited
+	MaxTotalUploadSize int64
+
+	// MaxDirBytes, when set, caps the bytes held by the upload directory. A file which would
+	// make it grow past the cap is rejected with ErrQuotaExceeded. The directory is measured
+	// with DirectorySize once per request, or once per DirSizeCacheTTL when it is set
+	MaxDirBytes     int64
+	DirSizeCacheTTL time.Duration
+
+	// ContentTypeDetector, when set, detects the type of uploaded files instead of
+	// http.DetectContentType, from their name and first SniffSize bytes. Returning an empty
+	// string falls back to http.DetectContentType
+	ContentTypeDetector func(fileName string, head []byte) string
+	// SniffSize is how many bytes of an uploaded file are read to detect its type, defaults
+	// to 512, which is all http.DetectContentType looks at
+	SniffSize int
+
+	// UploadSessionDir is where resumable upload sessions stage their files, defaults to an
+	// upload-sessions directory in os.TempDir()
+	UploadSessionDir string
+	// UploadSessionTTL is how long a session may go without receiving a chunk before it is
+	// removed, defaults to 24 hours
+	UploadSessionTTL time.Duration
+
+	// state is created on first use, copies of Tools made afterwards share it
+	state *toolsState
+}
+
+// toolsState is what a Tools keeps between calls. It stays behind a pointer so Tools
+// can be copied like any configuration value
+type toolsState struct {
+	// uploadSem holds a token for every file written under MaxConcurrentUploads
+	uploadSemMu sync.Mutex
+	uploadSem   chan struct{}
+
+	// dirSizes caches the sizes measured for MaxDirBytes, by directory
+	dirSizesMu sync.Mutex
+	dirSizes   map[string]dirSizeEntry
+}
+
+// toolsStateMu guards the creation of Tools.state
+var toolsStateMu sync.Mutex
+
+// sharedState returns the state of t, creating it on first use
+func (t *Tools) sharedState() *toolsState {
+	toolsStateMu.Lock()
+	defer toolsStateMu.Unlock()
+
+	if t.state == nil {
+		t.state = &toolsState{}
+	}
+
+	return t.state
 }
 
 // RandomString returns a string of random alphanumerical characters of length n,
-// using randomStringSource as the source for the string
+// using randomStringSource as the source for the string. When RandSource fails, like a
+// reader running out of bytes, the rest of the string is read from crypto/rand.Reader
 func (t *Tools) RandomString(n int) string {
 	s, r := make([]rune, n), []rune(randomStringSource)
+	src := t.randSource()
+
+	// bytes above the largest multiple of len(r) are skipped so every character is equally likely
+	limit := byte(256 - 256%len(r))
+	b := make([]byte, 1)
 	for i := range s {
-		p, _ := rand.Prime(rand.Reader, len(r))
-		x, y := p.Uint64(), uint64(len(r))
-		s[i] = r[x%y]
+		for {
+			_, err := io.ReadFull(src, b)
+			if err != nil && src != rand.Reader {
+				// every file name goes through here, so a broken source can't fail uploads
+				src = rand.Reader
+				_, err = io.ReadFull(src, b)
+			}
+			if err != nil {
+				panic("toolkit: reading random source: " + err.Error())
+			}
+			if b[0] < limit {
+				break
+			}
+		}
+		s[i] = r[int(b[0])%len(r)]
 	}
 
 	return string(s)
 }
 
+// randSource returns RandSource, or crypto/rand.Reader when it isn't set
+func (t *Tools) randSource() io.Reader {
+	if t.RandSource != nil {
+		return t.RandSource
+	}
+
+	return rand.Reader
+}
+
 // UploadedFile is a struct to save information of an uploaded file
 type UploadedFile struct {
-	OriginalFileName string
-	NewFileName      string
-	FileSize         int64
+	OriginalFileName string `json:"original_file_name"`
+	NewFileName      string `json:"new_file_name"`
+	FileSize         int64  `json:"file_size"`
+	// ContentType is the type detected from the file content, not the one declared by the client
+	ContentType string `json:"content_type"`
+	// FieldName is the name of the form field the file was sent in
+	FieldName string `json:"field_name"`
+	// ThumbnailFileName is the name of the thumbnail written next to the file when
+	// Tools.Thumbnail is set, and ThumbnailErr why it couldn't be written. ThumbnailErr
+	// is encoded to JSON as its message, under thumbnail_error
+	ThumbnailFileName string `json:"thumbnail_file_name"`
+	ThumbnailErr      error  `json:"-"`
+	// RelativePath is the path of the file inside the upload directory, NewFileName
+	// preceded by the UploadPathLayout and ShardUploads subdirectories, if any
+	RelativePath string `json:"relative_path"`
+	// UploadDir is the directory the file was saved in, the upload directory or the one
+	// chosen by Tools.UploadDirFunc, and is empty when it isn't saved on disk. Like FullPath
+	// it isn't encoded to JSON
+	UploadDir string `json:"-"`
+	// FullPath is the path the file was written to, UploadDir joined with RelativePath.
+	// It isn't encoded to JSON, so responses don't reveal the server filesystem
+	FullPath string `json:"-"`
+	// URL is where the file can be accessed, only set when Tools.PublicBaseURL is set
+	URL string `json:"url"`
+	// Checksum is the hex SHA-256 of the content, only set when Tools.DeduplicateUploads is set
+	Checksum string `json:"checksum"`
+	// ImageWidth and ImageHeight are the dimensions of png, jpeg and gif images, read from
+	// their header, and zero for other files
+	ImageWidth  int `json:"image_width"`
+	ImageHeight int `json:"image_height"`
+	// Duplicate reports that the content was already uploaded, the other fields then
+	// describe the file saved by the first upload, and no copy was written
+	Duplicate bool `json:"duplicate"`
+}
+
+// MarshalJSON encodes the file with snake_case keys, and ThumbnailErr as its message
+// under thumbnail_error, empty when the thumbnail was written
+func (f UploadedFile) MarshalJSON() ([]byte, error) {
+	// uploadedFile has the same fields but not the method, to avoid recursing
+	type uploadedFile UploadedFile
+	thumbnailError := ""
+	if f.ThumbnailErr != nil {
+		thumbnailError = f.ThumbnailErr.Error()
+	}
+
+	return json.Marshal(struct {
+		uploadedFile
+		ThumbnailError string `json:"thumbnail_error"`
+	}{uploadedFile(f), thumbnailError})
 }
 
+// ErrNoFileProvided is returned when an upload request doesn't contain any file
+var ErrNoFileProvided = errors.New("no files uploaded")
+
+// UploadOneFile uploads the files of r like UploadFiles and returns the first one.
+// ErrNoFileProvided is returned when the request contains no file
 func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
 	files, err := t.UploadFiles(r, uploadDir, rename...)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(files) == 0 {
+		return nil, ErrNoFileProvided
+	}
+
 	return files[0], nil
 }
 
-func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+// Base64File is the JSON body read by UploadBase64File. Data holds the file content in
+// standard base64, optionally as a data: URL, whose declared type is ignored
+type Base64File struct {
+	FileName string `json:"file_name"`
+	Data     string `json:"data"`
+}
+
+// ErrMalformedBase64 is returned when the data of a base64 upload can't be decoded
+var ErrMalformedBase64 = errors.New("the uploaded file data is not valid base64")
+
+// UploadBase64File reads a Base64File from the JSON body of r with ReadJSON and saves the
+// decoded file to uploadDir, with the same checks as UploadFiles. The type of the file is
+// always detected from its content
+func (t *Tools) UploadBase64File(w http.ResponseWriter, r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
 	renameFile := true
 	if len(rename) > 0 {
 		renameFile = rename[0]
 	}
 
-	var uploadedFiles []*UploadedFile
+	var payload Base64File
+	err := t.ReadJSON(w, r, &payload)
+	if err != nil {
+		return nil, err
+	}
 
-	if t.MaxFileSize == 0 {
-		t.MaxFileSize = defaultMaxFileSize
+	data := payload.Data
+	if strings.HasPrefix(data, "data:") {
+		i := strings.Index(data, ",")
+		if i < 0 || !strings.HasSuffix(data[:i], ";base64") {
+			return nil, newUploadError(payload.FileName, fmt.Errorf("%w: a data URL must be base64 encoded", ErrMalformedBase64))
+		}
+		data = data[i+1:]
+	}
+
+	content, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, newUploadError(payload.FileName, fmt.Errorf("%w: %v", ErrMalformedBase64, err))
+	}
+
+	size := int64(len(content))
+	if size > t.largestFileSize() {
+		return nil, newUploadError(payload.FileName, t.fileTooBigError(payload.FileName, size))
 	}
 
-	err := r.ParseMultipartForm(t.MaxFileSize)
+	uploadedFile, err := t.saveFile(t.newUploadBatch(r.Context(), uploadDir, renameFile), "", payload.FileName, nil, size, bytes.NewReader(content))
 	if err != nil {
-		return nil, errors.New("the uploaded file is too big")
+		return nil, newUploadError(payload.FileName, err)
 	}
 
-	err = t.CreateDirIfNotExist(uploadDir)
+	return uploadedFile, nil
+}
+
+// UploadRawBody saves the body of r, a file sent as is rather than in a multipart form as
+// with a PUT, to uploadDir with the same checks as UploadFiles. fileName is used as the
+// original name of the file, and when empty the last segment of the URL path is
+func (t *Tools) UploadRawBody(r *http.Request, uploadDir string, fileName string, rename ...bool) (*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	if fileName == "" {
+		fileName = path.Base(r.URL.Path)
+	}
+
+	err := t.prepareUpload(r)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, hdr := range fHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+	// the length is unknown when the body is compressed or sent in chunks
+	size := r.ContentLength
+	if size > t.largestFileSize() {
+		return nil, newUploadError(fileName, t.fileTooBigError(fileName, size))
+	}
 
-				// sample first 512 bytes
-				buff := make([]byte, 512)
-				_, err = infile.Read(buff)
-				if err != nil {
-					return nil, err
-				}
+	uploadedFile, err := t.saveFile(t.newUploadBatch(r.Context(), uploadDir, renameFile), "", fileName, nil, size, r.Body)
+	if err != nil {
+		return nil, newUploadError(fileName, err)
+	}
 
-				// check to see if the file type is permitted
-				allowed := false
-				fileType := http.DetectContentType(buff)
-				allowedTypes := t.AllowedFileTypes
-
-				if len(allowedTypes) > 0 {
-					for _, a := range allowedTypes {
-						if strings.EqualFold(fileType, a) {
-							allowed = true
-							break
-						}
-					}
-				}
+	return uploadedFile, nil
+}
 
-				if !allowed {
-					return nil, errors.New("the uploaded file type is not permitted")
-				}
+// UploadSessionMeta describes the file of a resumable upload session
+type UploadSessionMeta struct {
+	// FileName is the original name of the file
+	FileName string `json:"file_name"`
+	// UploadDir is where the file is saved once the session is complete
+	UploadDir string `json:"upload_dir"`
+	// Size, when set, is the expected size of the file. A session with less data can't be
+	// completed, and more is rejected
+	Size int64 `json:"size"`
+	// KeepFileName saves the file under its original name instead of a random one
+	KeepFileName bool `json:"keep_file_name"`
+}
 
-				// restart the file pointer
-				_, err = infile.Seek(0, 0)
-				if err != nil {
-					return nil, err
-				}
+// ErrUploadSessionNotFound is returned for a session which doesn't exist or expired
+var ErrUploadSessionNotFound = errors.New("the upload session doesn't exist or expired")
 
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(hdr.Filename))
-				} else {
-					uploadedFile.NewFileName = hdr.Filename
-				}
+// ErrUploadSessionIncomplete is returned when completing a session which received less
+// than the Size of its UploadSessionMeta
+var ErrUploadSessionIncomplete = errors.New("the upload session is missing data")
 
-				uploadedFile.OriginalFileName = hdr.Filename
+// ErrInvalidChunkOffset is returned for a chunk which doesn't start where the data
+// received by the session ends, or earlier
+var ErrInvalidChunkOffset = errors.New("the chunk offset is invalid")
 
-				var outfile *os.File
+// ChunkOffsetError is returned when a chunk starts after the end of the data received so
+// far, which is the offset the next chunk should have. It matches ErrInvalidChunkOffset
+type ChunkOffsetError struct {
+	Offset   int64
+	Expected int64
+}
 
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
-					return nil, err
-				}
-				defer outfile.Close()
+func (e *ChunkOffsetError) Error() string {
+	return fmt.Sprintf("%s: got %d, expected at most %d", ErrInvalidChunkOffset, e.Offset, e.Expected)
+}
 
-				fileSize, err := io.Copy(outfile, infile)
-				if err != nil {
-					return nil, err
-				}
+func (e *ChunkOffsetError) Unwrap() error {
+	return ErrInvalidChunkOffset
+}
 
-				uploadedFile.FileSize = fileSize
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+// uploadSessionLocks serializes the operations on one session, by staging file path
+var uploadSessionLocks sync.Map
 
-				return uploadedFiles, nil
+// uploadSessionIDPattern matches the ids returned by StartUploadSession
+var uploadSessionIDPattern = regexp.MustCompile(`^[a-zA-Z0-9]{32}$`)
 
-			}(uploadedFiles)
-			if err != nil {
-				return uploadedFiles, errors.New("upload file error")
-			}
-		}
+// StartUploadSession starts a resumable upload of the file described by meta and returns
+// the id of the session. The file is sent with AppendUploadChunk and saved once the session
+// is completed with CompleteUploadSession. Expired sessions are removed first
+func (t *Tools) StartUploadSession(meta UploadSessionMeta) (string, error) {
+	if meta.Size > t.largestFileSize() {
+		return "", t.fileTooBigError(meta.FileName, meta.Size)
 	}
 
-	return uploadedFiles, nil
-}
+	err := t.CleanupUploadSessions()
+	if err != nil {
+		return "", err
+	}
 
-// CreateDirIfNotExist is used to create a directory if the given path does not exists
-func (t *Tools) CreateDirIfNotExist(path string) error {
-	const mode = 0755
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.MkdirAll(path, mode)
-		if err != nil {
-			return err
-		}
+	err = t.CreateDirIfNotExist(t.uploadSessionDir())
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	id := t.RandomString(32)
+	partPath, metaPath := t.uploadSessionPaths(id)
+	err = os.WriteFile(metaPath, data, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		_ = os.Remove(metaPath)
+		return "", err
+	}
+
+	return id, f.Close()
 }
 
-// Slugify is used to convert string to URL safe string (slug)
-func (t *Tools) Slugify(s string) (string, error) {
-	if s == "" {
-		return "", errors.New("empty string not permitted")
+// AppendUploadChunk writes the data read from r at offset in the file of the session.
+// offset may not be past the end of the data received so far. A chunk starting before it,
+// such as a chunk sent again after a failure, replaces the data from offset on
+func (t *Tools) AppendUploadChunk(sessionID string, offset int64, r io.Reader) error {
+	unlock, meta, err := t.openUploadSession(sessionID)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	re := regexp.MustCompile(`[^a-z\d]+`)
+	partPath, _ := t.uploadSessionPaths(sessionID)
+	f, err := os.OpenFile(partPath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > info.Size() {
+		return &ChunkOffsetError{Offset: offset, Expected: info.Size()}
+	}
 
-	if len(slug) == 0 {
-		return "", errors.New("after removing characters, slug is zero length")
+	err = f.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
 	}
 
-	return slug, nil
-}
+	limit := t.largestFileSize()
+	if meta.Size > 0 {
+		limit = meta.Size
+	}
 
-// DownloadStaticFile downloads a file, and tries to force browsers to avoid
-// displaying it in the browser window by setting content disposition.
-// It also allows specification of the display name
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	// one byte more than allowed is enough to know the limit is exceeded
+	n, err := io.Copy(f, io.LimitReader(r, limit-offset+1))
+	if err == nil && offset+n > limit {
+		err = t.fileTooBigError(meta.FileName, offset+n)
+	}
+	if err != nil {
+		// the session stays usable from offset on
+		_ = f.Truncate(offset)
+		return err
+	}
 
-	http.ServeFile(w, r, pathName)
+	return f.Sync()
 }
 
-// JSONResponse is the type used for sending JSON around
-type JSONResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
-}
+// CompleteUploadSession saves the file of the session to its upload directory with the same
+// checks as UploadFiles and removes the session. A session missing data is kept, so the
+// rest can still be sent
+func (t *Tools) CompleteUploadSession(sessionID string) (*UploadedFile, error) {
+	unlock, meta, err := t.openUploadSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-// ReadJSON is used to read request and then send it back
-func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
-	maxSize := int64(defaultMaxJSONSize)
-	if t.MaxJSONSize != 0 {
-		maxSize = t.MaxJSONSize
+	partPath, metaPath := t.uploadSessionPaths(sessionID)
+	f, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if meta.Size > 0 && info.Size() < meta.Size {
+		return nil, fmt.Errorf("%w: got %d of %d bytes", ErrUploadSessionIncomplete, info.Size(), meta.Size)
+	}
 
-	dec := json.NewDecoder(r.Body)
+	// the session ends here, whether the file passes the checks or not
+	defer func() {
+		_ = os.Remove(partPath)
+		_ = os.Remove(metaPath)
+		uploadSessionLocks.Delete(partPath)
+	}()
 
-	if !t.AllowUnknownFields {
-		dec.DisallowUnknownFields()
+	batch := t.newUploadBatch(context.Background(), meta.UploadDir, !meta.KeepFileName)
+	uploadedFile, err := t.saveFile(batch, "", meta.FileName, nil, info.Size(), f)
+	if err != nil {
+		return nil, newUploadError(meta.FileName, err)
 	}
 
-	err := dec.Decode(data)
+	return uploadedFile, nil
+}
+
+// CleanupUploadSessions removes the sessions which didn't receive a chunk within
+// UploadSessionTTL. StartUploadSession calls it, and it can also be run periodically
+func (t *Tools) CleanupUploadSessions() error {
+	entries, err := os.ReadDir(t.uploadSessionDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
+		return err
+	}
 
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
-		case errors.As(err, &unmarshalTypeError):
-			return fmt.Errorf("body contains badly-formed JSON")
-		case errors.As(err, &invalidUnmarshalError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxSize)
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshalling JSON: %s", err)
-		default:
-			return err
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".part")
+		if id == e.Name() || !uploadSessionIDPattern.MatchString(id) {
+			continue
 		}
-	}
 
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must contain only one JSON value")
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < t.uploadSessionTTL() {
+			continue
+		}
+
+		partPath, metaPath := t.uploadSessionPaths(id)
+		unlock := t.lockUploadSession(partPath)
+		_ = os.Remove(partPath)
+		_ = os.Remove(metaPath)
+		uploadSessionLocks.Delete(partPath)
+		unlock()
 	}
 
 	return nil
 }
 
-// WriteJSON takes response, request, status, data, will respond to client in JSON
-func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
-	if len(headers) > 0 {
-		for key, value := range headers[0] {
-			w.Header()[key] = value
-		}
+// openUploadSession locks the session and reads its metadata. A session which expired is
+// removed. The returned function unlocks the session
+func (t *Tools) openUploadSession(sessionID string) (func(), *UploadSessionMeta, error) {
+	if !uploadSessionIDPattern.MatchString(sessionID) {
+		return nil, nil, ErrUploadSessionNotFound
 	}
 
-	w.Header().Set("Application-Type", "application/json")
-	w.WriteHeader(status)
-	err := json.NewEncoder(w).Encode(data)
+	partPath, metaPath := t.uploadSessionPaths(sessionID)
+	unlock := t.lockUploadSession(partPath)
+
+	info, err := os.Stat(partPath)
 	if err != nil {
-		return err
+		unlock()
+		return nil, nil, ErrUploadSessionNotFound
 	}
-	return nil
+	if time.Since(info.ModTime()) >= t.uploadSessionTTL() {
+		_ = os.Remove(partPath)
+		_ = os.Remove(metaPath)
+		uploadSessionLocks.Delete(partPath)
+		unlock()
+		return nil, nil, ErrUploadSessionNotFound
+	}
+
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		unlock()
+		return nil, nil, ErrUploadSessionNotFound
+	}
+
+	var meta UploadSessionMeta
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	return unlock, &meta, nil
 }
 
-// ErrorJSON is used to format an error into JSON response
-func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
+// lockUploadSession locks the session staged at partPath and returns the unlock function
+func (t *Tools) lockUploadSession(partPath string) func() {
+	mu, _ := uploadSessionLocks.LoadOrStore(partPath, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
 
-	if len(status) > 0 {
-		statusCode = status[0]
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (t *Tools) uploadSessionDir() string {
+	if t.UploadSessionDir != "" {
+		return t.UploadSessionDir
 	}
 
-	errResponse := JSONResponse{
-		Error:   true,
-		Message: err.Error(),
+	return filepath.Join(os.TempDir(), "upload-sessions")
+}
+
+func (t *Tools) uploadSessionTTL() time.Duration {
+	if t.UploadSessionTTL > 0 {
+		return t.UploadSessionTTL
 	}
 
-	return t.WriteJSON(w, statusCode, errResponse)
+	return 24 * time.Hour
 }
 
-// PushJSONToRemote is used to push JSON to specified uri
-// Http client is optional, if not specified we use default Http Client
-func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, error) {
-	payload, err := json.Marshal(data)
+// uploadSessionPaths returns the paths of the staged file and of the metadata of a session
+func (t *Tools) uploadSessionPaths(sessionID string) (string, string) {
+	base := filepath.Join(t.uploadSessionDir(), sessionID)
+	return base + ".part", base + ".json"
+}
+
+// UploadOneFileFromField works like UploadOneFile, but only saves the first file sent
+// in the form field named field, ignoring every other file of the request
+func (t *Tools) UploadOneFileFromField(r *http.Request, uploadDir, field string, rename ...bool) (*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	err := t.parseUploadForm(r, uploadDir)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(payload))
+	fHeaders := r.MultipartForm.File[field]
+	if len(fHeaders) == 0 {
+		return nil, ErrNoFileProvided
+	}
+
+	uploadedFile, err := t.saveUploadedFile(t.newUploadBatch(r.Context(), uploadDir, renameFile), field, fHeaders[0])
 	if err != nil {
-		return nil, err
+		return nil, newUploadError(fHeaders[0].Filename, err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	var httpClient http.Client
-	if len(client) > 0 {
-		httpClient = *client[0]
+	return uploadedFile, nil
+}
+
+// UploadFiles saves every file of the multipart form of r to uploadDir, renaming them unless
+// rename is false. ErrNoFileProvided is returned when the form contains no file.
+// The files are returned in the order they were sent. When the handler already parsed the
+// form, which doesn't keep that order across fields, they are grouped by field in name order
+func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	return t.UploadFilesWithContext(r.Context(), r, uploadDir, rename...)
+}
+
+// UploadCanceledError is returned when the context of an upload is done before every file
+// is saved. It wraps the error of the context
+type UploadCanceledError struct {
+	Err error
+}
+
+func (e *UploadCanceledError) Error() string {
+	return fmt.Sprintf("the upload was canceled: %s", e.Err)
+}
+
+func (e *UploadCanceledError) Unwrap() error {
+	return e.Err
+}
+
+// UploadFilesWithContext works like UploadFiles, but stops as soon as ctx is done, removing
+// the file being written, and returns an UploadCanceledError
+func (t *Tools) UploadFilesWithContext(ctx context.Context, r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	return t.uploadBatchFiles(r, t.newUploadBatch(ctx, uploadDir, renameFile))
+}
+
+// uploadBatchFiles saves the files of r with batch, streaming the form unless the
+// handler already parsed it
+func (t *Tools) uploadBatchFiles(r *http.Request, batch *uploadBatch) (uploadedFiles []*UploadedFile, err error) {
+	defer func(start time.Time) {
+		var n int64
+		for _, f := range uploadedFiles {
+			n += f.FileSize
+		}
+		t.record(MetricUpload, start, n, err)
+	}(time.Now())
+
+	batch.request = r
+
+	// a form the handler already parsed can't be streamed anymore
+	if r.MultipartForm != nil {
+		uploadedFiles, err = t.uploadParsedForm(r, batch)
 	} else {
-		httpClient = http.Client{}
+		uploadedFiles, err = t.uploadStream(r, batch)
+	}
+	if err != nil {
+		// with ContinueOnUploadError the files saved are returned along the failures
+		return uploadedFiles, err
 	}
 
-	res, err := httpClient.Do(req)
+	if len(uploadedFiles) == 0 {
+		return nil, ErrNoFileProvided
+	}
+
+	return uploadedFiles, nil
+}
+
+// MemoryUploadedFile is a file uploaded with UploadFilesToMemory
+type MemoryUploadedFile struct {
+	OriginalFileName string
+	// ContentType is the type detected from the file content, not the one declared by the client
+	ContentType string
+	// FieldName is the name of the form field the file was sent in
+	FieldName string
+	FileSize  int64
+	Data      []byte
+}
+
+// UploadFilesToMemory works like UploadFiles, with the same checks, but keeps the files in
+// memory instead of writing them to disk. MaxFileSize caps every file, and should be set
+// along MaxUploadCount or MaxTotalUploadSize to bound the memory a request can take
+func (t *Tools) UploadFilesToMemory(r *http.Request) ([]*MemoryUploadedFile, error) {
+	storage := &memoryStorage{files: make(map[string][]byte)}
+	batch := t.newUploadBatch(r.Context(), "", true)
+	batch.storage = storage
+
+	uploadedFiles, err := t.uploadBatchFiles(r, batch)
+
+	// with ContinueOnUploadError the files kept are returned along the failures
+	var files []*MemoryUploadedFile
+	for _, f := range uploadedFiles {
+		files = append(files, &MemoryUploadedFile{
+			OriginalFileName: f.OriginalFileName,
+			ContentType:      f.ContentType,
+			FieldName:        f.FieldName,
+			FileSize:         f.FileSize,
+			Data:             storage.files[filepath.ToSlash(f.RelativePath)],
+		})
+	}
+
+	return files, err
+}
+
+// memoryStorage is the FileStorage of UploadFilesToMemory
+type memoryStorage struct {
+	// mu guards files, which concurrent uploads share
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memoryStorage) Save(ctx context.Context, name string, r io.Reader) (int64, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = buf.Bytes()
+	return n, nil
+}
+
+func (m *memoryStorage) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+	return nil
+}
+
+// UploadValidationResult tells whether a file of the request given to ValidateFiles would
+// be accepted, and why not otherwise
+type UploadValidationResult struct {
+	FileName string `json:"file_name"`
+	// FieldName is the name of the form field the file was sent in
+	FieldName string `json:"field_name"`
+	// ContentType and FileSize are only set for accepted files, since a rejected file
+	// may not have been read to the end
+	ContentType string `json:"content_type"`
+	FileSize    int64  `json:"file_size"`
+	Accepted    bool   `json:"accepted"`
+	// Reason and Err describe why the file would be rejected. Err is encoded to JSON as
+	// its message, under error
+	Reason UploadErrorReason `json:"reason"`
+	Err    error             `json:"-"`
+}
+
+// MarshalJSON encodes the result with snake_case keys, and Err as its message under error,
+// empty when the file would be accepted
+func (v UploadValidationResult) MarshalJSON() ([]byte, error) {
+	// validationResult has the same fields but not the method, to avoid recursing
+	type validationResult UploadValidationResult
+	message := ""
+	if v.Err != nil {
+		message = v.Err.Error()
+	}
+
+	return json.Marshal(struct {
+		validationResult
+		Error string `json:"error"`
+	}{validationResult(v), message})
+}
+
+// ValidateFiles runs every check UploadFiles would on the files of r, from their type to
+// their size and name, and returns whether each would be accepted, in the order they were
+// sent. Nothing is written to disk: the files are read and thrown away, so the checks
+// needing the upload directory, like MaxDirBytes and name collisions, are skipped, and
+// OnFileUploaded isn't called. An error is returned when the request as a whole would be
+// rejected, like when it exceeds MaxTotalUploadSize or MaxUploadCount
+func (t *Tools) ValidateFiles(r *http.Request, rename ...bool) ([]*UploadValidationResult, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	batch := t.newUploadBatch(r.Context(), "", renameFile)
+	batch.storage = discardStorage{}
+	batch.validating = true
+	batch.continueOnError = true
+
+	var err error
+	if r.MultipartForm != nil {
+		_, err = t.uploadParsedForm(r, batch)
+	} else {
+		_, err = t.uploadStream(r, batch)
+	}
+
+	// the files rejected are already in the results
+	var failures UploadErrors
+	if err != nil && !errors.As(err, &failures) {
+		return nil, err
+	}
+
+	if len(batch.results) == 0 {
+		return nil, ErrNoFileProvided
+	}
+
+	return batch.results, nil
+}
+
+// addResult records the outcome of a file for ValidateFiles, and does nothing otherwise
+func (b *uploadBatch) addResult(field, fileName string, file *UploadedFile, err error) {
+	if !b.validating {
+		return
+	}
+
+	if err != nil {
+		uploadErr := newUploadError(fileName, err)
+		b.results = append(b.results, &UploadValidationResult{
+			FileName:  decodeFileName(fileName),
+			FieldName: field,
+			Reason:    uploadErr.Reason,
+			Err:       err,
+		})
+		return
+	}
+
+	b.results = append(b.results, &UploadValidationResult{
+		FileName:    file.OriginalFileName,
+		FieldName:   file.FieldName,
+		ContentType: file.ContentType,
+		FileSize:    file.FileSize,
+		Accepted:    true,
+	})
+}
+
+// discardStorage is the FileStorage of ValidateFiles, which reads the files to check them
+// and keeps nothing
+type discardStorage struct{}
+
+func (discardStorage) Save(ctx context.Context, name string, r io.Reader) (int64, error) {
+	return io.Copy(io.Discard, &contextReader{ctx: ctx, r: r})
+}
+
+func (discardStorage) Remove(name string) error {
+	return nil
+}
+
+// maxFormValuesSize caps the total size of the text fields kept by uploadStream
+const maxFormValuesSize = 10 << 20 // 10 MB
+
+// uploadStream reads the multipart body of r part by part, writing each file straight to
+// uploadDir instead of buffering the whole form first. Text fields are kept in
+// r.MultipartForm and r.Form, so r.FormValue keeps working after the upload
+func (t *Tools) uploadStream(r *http.Request, batch *uploadBatch) (_ []*UploadedFile, err error) {
+	ctx := batch.ctx
+	err = t.prepareUpload(r)
 	if err != nil {
 		return nil, err
 	}
-	// defer res.Body.Close()
 
-	return res, nil
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, uploadFormError(err)
+	}
+
+	// like with ParseMultipartForm the form is always read to the end, so clients
+	// still sending it aren't left blocked
+	defer func() {
+		if err != nil {
+			for {
+				if _, partErr := mr.NextPart(); partErr != nil {
+					break
+				}
+			}
+		}
+	}()
+
+	if dir, ok := batch.localDir(); ok && dir != "" {
+		err = t.CreateDirIfNotExist(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var uploadedFiles []*UploadedFile
+	var failures UploadErrors
+	// rejecting the request removes what it already wrote
+	reject := func(err error) ([]*UploadedFile, error) {
+		batch.removeFiles(uploadedFiles)
+		return nil, err
+	}
+
+	values := make(url.Values)
+	valuesSize := int64(0)
+	defer setFormValues(r, values)
+
+	// with several workers, files are only saved once the whole form was received
+	var jobs []*uploadJob
+	var spooled []*os.File
+	defer func() {
+		for _, f := range spooled {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, uploadFormError(err)
+		}
+
+		field, fileName := part.FormName(), part.FileName()
+		if fileName == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValuesSize-valuesSize+1))
+			if err != nil {
+				return nil, uploadFormError(err)
+			}
+			valuesSize += int64(len(value))
+			if valuesSize > maxFormValuesSize {
+				return nil, errors.New("the form values are too big")
+			}
+			values.Add(field, string(value))
+			continue
+		}
+
+		if t.UploadFieldName != "" && field != t.UploadFieldName {
+			if t.RejectUnexpectedUploadFields {
+				return reject(fmt.Errorf("%w: %q", ErrUnexpectedUploadField, field))
+			}
+			continue
+		}
+
+		if t.MaxUploadCount > 0 && len(uploadedFiles)+len(jobs) >= t.MaxUploadCount {
+			return reject(fmt.Errorf("%w: the limit is %d", ErrTooManyFiles, t.MaxUploadCount))
+		}
+
+		if ctx.Err() != nil {
+			return reject(&UploadCanceledError{Err: ctx.Err()})
+		}
+
+		if t.UploadConcurrency > 1 {
+			job, err := t.spoolPart(batch, field, fileName, part, &spooled)
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, job)
+			continue
+		}
+
+		uploadedFile, err := t.saveFile(batch, field, fileName, part.Header, -1, part)
+		batch.addResult(field, fileName, uploadedFile, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return reject(&UploadCanceledError{Err: ctx.Err()})
+			}
+			if errors.Is(err, ErrTotalSizeExceeded) {
+				return reject(err)
+			}
+			if batch.continueOnError {
+				failures = append(failures, newUploadError(fileName, err))
+				continue
+			}
+			return nil, newUploadError(fileName, err)
+		}
+		uploadedFiles = append(uploadedFiles, uploadedFile)
+	}
+
+	if len(jobs) > 0 {
+		return t.saveJobs(batch, jobs)
+	}
+
+	if len(failures) > 0 {
+		return uploadedFiles, failures
+	}
+
+	return uploadedFiles, nil
+}
+
+// removeFiles deletes files saved by a request which ends up rejected, and their thumbnails
+func (b *uploadBatch) removeFiles(files []*UploadedFile) {
+	for _, f := range files {
+		// a duplicate is a file saved by an earlier request
+		if f.Duplicate {
+			continue
+		}
+		storage := b.storage
+		if f.UploadDir != "" {
+			// the file may have been saved in a directory chosen by UploadDirFunc
+			storage = &LocalStorage{Dir: f.UploadDir}
+		}
+		_ = storage.Remove(filepath.ToSlash(f.RelativePath))
+
+		if f.ThumbnailFileName != "" && f.FullPath != "" {
+			_ = os.Remove(filepath.Join(filepath.Dir(f.FullPath), f.ThumbnailFileName))
+		}
+	}
+}
+
+// setFormValues exposes the text fields read by uploadStream like ParseMultipartForm would
+func setFormValues(r *http.Request, values url.Values) {
+	r.MultipartForm = &multipart.Form{Value: values, File: make(map[string][]*multipart.FileHeader)}
+
+	// only reads the query, the body of a multipart request is left alone
+	_ = r.ParseForm()
+	if r.PostForm == nil {
+		r.PostForm = make(url.Values)
+	}
+
+	for key, vs := range values {
+		r.Form[key] = append(r.Form[key], vs...)
+		r.PostForm[key] = append(r.PostForm[key], vs...)
+	}
+}
+
+// uploadParsedForm saves the files of the already parsed multipart form of r. The form
+// doesn't keep the order of its fields, so they are saved in name order
+func (t *Tools) uploadParsedForm(r *http.Request, batch *uploadBatch) ([]*UploadedFile, error) {
+	err := t.parseUploadForm(r, batch.uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := t.uploadFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*uploadJob
+	for _, field := range sortedFields(fields) {
+		for _, hdr := range fields[field] {
+			field, hdr := field, hdr
+			jobs = append(jobs, &uploadJob{field: field, fileName: hdr.Filename, save: func() (*UploadedFile, error) {
+				return t.saveUploadedFile(batch, field, hdr)
+			}})
+		}
+	}
+
+	return t.saveJobs(batch, jobs)
+}
+
+// uploadJob is a file of a request waiting to be saved by saveJobs
+type uploadJob struct {
+	field    string
+	fileName string
+	save     func() (*UploadedFile, error)
+	file     *UploadedFile
+	err      error
+	done     bool
+}
+
+// saveJobs saves the files of jobs with UploadConcurrency workers and returns them in the
+// order of jobs. Failures are handled like when the files are saved one after the other
+func (t *Tools) saveJobs(batch *uploadBatch, jobs []*uploadJob) ([]*UploadedFile, error) {
+	ctx := batch.ctx
+
+	workers := t.UploadConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	// once a file fails the files after it aren't started, like when saving them one by one
+	var mu sync.Mutex
+	failed := false
+	queue := make(chan *uploadJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				mu.Lock()
+				skip := failed
+				mu.Unlock()
+				if skip || ctx.Err() != nil {
+					continue
+				}
+
+				j.file, j.err = j.save()
+				j.done = true
+				if j.err != nil && (!batch.continueOnError || errors.Is(j.err, ErrTotalSizeExceeded)) {
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	saved := func(jobs []*uploadJob) []*UploadedFile {
+		var files []*UploadedFile
+		for _, j := range jobs {
+			if j.file != nil {
+				files = append(files, j.file)
+			}
+		}
+		return files
+	}
+
+	var uploadedFiles []*UploadedFile
+	var failures UploadErrors
+	// jobs are started in order, so those skipped all come after the first failing one
+	for i, j := range jobs {
+		if (!j.done || j.err != nil) && ctx.Err() != nil {
+			// the caller never gets the files saved before the cancellation
+			batch.removeFiles(saved(jobs))
+			return nil, &UploadCanceledError{Err: ctx.Err()}
+		}
+		if j.done {
+			batch.addResult(j.field, j.fileName, j.file, j.err)
+		}
+
+		if j.err != nil {
+			if errors.Is(j.err, ErrTotalSizeExceeded) {
+				batch.removeFiles(saved(jobs))
+				return nil, j.err
+			}
+			if batch.continueOnError {
+				failures = append(failures, newUploadError(j.fileName, j.err))
+				continue
+			}
+
+			// the files saved after this one wouldn't have been with a single worker
+			batch.removeFiles(saved(jobs[i+1:]))
+			return nil, newUploadError(j.fileName, j.err)
+		}
+		uploadedFiles = append(uploadedFiles, j.file)
+	}
+
+	if len(failures) > 0 {
+		return uploadedFiles, failures
+	}
+
+	return uploadedFiles, nil
+}
+
+// spoolPart copies a file part of a streamed form to a temporary file, so it can be saved
+// once the rest of the form is read, and returns the job saving it. The temporary file is
+// added to spooled, for the caller to remove
+func (t *Tools) spoolPart(batch *uploadBatch, field, fileName string, part *multipart.Part, spooled *[]*os.File) (*uploadJob, error) {
+	f, err := os.CreateTemp("", "upload-")
+	if err != nil {
+		return nil, err
+	}
+	*spooled = append(*spooled, f)
+
+	// one byte more than allowed is enough to know the limit is exceeded
+	size, err := io.Copy(f, io.LimitReader(part, t.largestFileSize()+1))
+	if err != nil {
+		return nil, uploadFormError(err)
+	}
+
+	job := &uploadJob{field: field, fileName: fileName, save: func() (*UploadedFile, error) {
+		if size > t.largestFileSize() {
+			return nil, t.fileTooBigError(fileName, size)
+		}
+
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		return t.saveFile(batch, field, fileName, part.Header, size, f)
+	}}
+
+	return job, nil
+}
+
+// UploadOptions is used to configure UploadFilesWithSummary
+type UploadOptions struct {
+	// KeepFileName stores files under their original name instead of a random one
+	KeepFileName bool
+	// DefaultDir is where UploadFilesWithMapping saves files of fields missing from the mapping.
+	// When empty, those files are reported as errors
+	DefaultDir string
+}
+
+// UploadErrorReason categorizes an UploadError so handlers can pick a response status
+type UploadErrorReason int
+
+const (
+	// UploadErrorOther is any failure not covered by another reason
+	UploadErrorOther UploadErrorReason = iota
+	// UploadErrorTypeNotPermitted is a file rejected because of its type or extension
+	UploadErrorTypeNotPermitted
+	// UploadErrorTooLarge is a file larger than MaxFileSize or MaxTotalUploadSize, or
+	// smaller than MinFileSize, or an image larger than MaxImageWidth or MaxImageHeight,
+	// or a file which doesn't fit in MaxDirBytes
+	UploadErrorTooLarge
+	// UploadErrorInvalidName is a file whose name can't be used
+	UploadErrorInvalidName
+	// UploadErrorIOFailure is a failure reading the file or writing it to disk
+	UploadErrorIOFailure
+	// UploadErrorRejectedByScanner is a file UploadScanner refused
+	UploadErrorRejectedByScanner
+)
+
+// UploadError describes why a single file of an upload failed. It is returned by UploadFiles
+// and UploadOneFile, and wraps the underlying error for errors.Is and errors.As
+type UploadError struct {
+	FileName string
+	Reason   UploadErrorReason
+	Err      error
+}
+
+// newUploadError wraps the error saving the file named fileName, categorizing it
+func newUploadError(fileName string, err error) *UploadError {
+	reason := UploadErrorOther
+
+	var pathErr *os.PathError
+	var errno syscall.Errno
+	var scanErr *ScanError
+	switch {
+	case errors.As(err, &scanErr):
+		reason = UploadErrorRejectedByScanner
+	case errors.Is(err, ErrFileTypeNotPermitted), errors.Is(err, ErrFileExtensionNotPermitted), errors.Is(err, ErrExtensionMismatch), errors.Is(err, ErrContentTypeMismatch):
+		reason = UploadErrorTypeNotPermitted
+	case errors.Is(err, ErrFileTooBig), errors.Is(err, ErrTotalSizeExceeded), errors.Is(err, ErrFileTooSmall), errors.Is(err, ErrImageTooLarge), errors.Is(err, ErrQuotaExceeded):
+		reason = UploadErrorTooLarge
+	case errors.Is(err, ErrInvalidFileName), errors.Is(err, ErrFileNameTooLong), errors.Is(err, ErrDuplicateFileName), errors.Is(err, ErrFileExists):
+		reason = UploadErrorInvalidName
+	case errors.As(err, &pathErr), errors.As(err, &errno), errors.Is(err, io.ErrUnexpectedEOF):
+		reason = UploadErrorIOFailure
+	}
+
+	return &UploadError{FileName: fileName, Reason: reason, Err: err}
+}
+
+func (e *UploadError) Error() string {
+	// errors like BlockedFileTypeError and ScanError already start with the file name
+	msg := e.Err.Error()
+	if strings.HasPrefix(msg, e.FileName+": ") {
+		return msg
+	}
+
+	return fmt.Sprintf("%s: %s", e.FileName, msg)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// UploadErrors is returned by UploadFiles, along the files it saved, when
+// ContinueOnUploadError is set and some files failed
+type UploadErrors []*UploadError
+
+func (e UploadErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns every failure, so ErrorJSON sends them as a list
+func (e UploadErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// UploadSummary is the report returned by UploadFilesWithSummary. Files are listed in
+// the order of their form field names
+type UploadSummary struct {
+	Uploaded []*UploadedFile
+	// Skipped holds the original names of files rejected because of their type
+	Skipped []string
+	Errors  []*UploadError
+}
+
+// UploadFilesWithSummary works like UploadFiles, but instead of stopping at the first
+// failing file it carries on with the rest and reports what happened to each file.
+// The returned error is only set when the request itself can't be processed
+func (t *Tools) UploadFilesWithSummary(r *http.Request, uploadDir string, opts UploadOptions) (*UploadSummary, error) {
+	err := t.parseUploadForm(r, uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := t.uploadFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &UploadSummary{}
+	batch := t.newUploadBatch(r.Context(), uploadDir, !opts.KeepFileName)
+
+	for _, field := range sortedFields(fields) {
+		for _, hdr := range fields[field] {
+			t.saveToSummary(batch, summary, field, hdr)
+		}
+	}
+
+	return summary, nil
+}
+
+// UploadFilesWithMapping works like UploadFilesWithSummary, but saves the files of each form
+// field to the directory fieldDirs maps it to, falling back to opts.DefaultDir
+func (t *Tools) UploadFilesWithMapping(r *http.Request, fieldDirs map[string]string, opts UploadOptions) (*UploadSummary, error) {
+	err := t.parseUploadForm(r, opts.DefaultDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := t.uploadFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &UploadSummary{}
+	batches := make(map[string]*uploadBatch)
+
+	for _, field := range sortedFields(fields) {
+		fHeaders := fields[field]
+		dir, ok := fieldDirs[field]
+		if !ok {
+			dir = opts.DefaultDir
+		}
+
+		if dir == "" {
+			for _, hdr := range fHeaders {
+				summary.Errors = append(summary.Errors, newUploadError(hdr.Filename, fmt.Errorf("no upload directory for field %q", field)))
+			}
+			continue
+		}
+
+		batch, ok := batches[dir]
+		if !ok {
+			if t.Storage == nil {
+				err = t.CreateDirIfNotExist(dir)
+				if err != nil {
+					return nil, err
+				}
+			}
+			batch = t.newUploadBatch(r.Context(), dir, !opts.KeepFileName)
+			batches[dir] = batch
+		}
+
+		for _, hdr := range fHeaders {
+			t.saveToSummary(batch, summary, field, hdr)
+		}
+	}
+
+	return summary, nil
+}
+
+// saveToSummary saves hdr, sent in the form field named field, and records the outcome in summary
+func (t *Tools) saveToSummary(batch *uploadBatch, summary *UploadSummary, field string, hdr *multipart.FileHeader) {
+	uploadedFile, err := t.saveUploadedFile(batch, field, hdr)
+	switch {
+	case errors.Is(err, ErrFileTypeNotPermitted):
+		summary.Skipped = append(summary.Skipped, hdr.Filename)
+	case err != nil:
+		summary.Errors = append(summary.Errors, newUploadError(hdr.Filename, err))
+	default:
+		summary.Uploaded = append(summary.Uploaded, uploadedFile)
+	}
+}
+
+// UploadEventType identifies what an UploadEvent reports
+type UploadEventType int
+
+const (
+	// UploadStarted is sent before a file is processed
+	UploadStarted UploadEventType = iota
+	// UploadCompleted is sent once a file is saved, File holds its information
+	UploadCompleted
+	// UploadFailed is sent when a file could not be saved, Err holds the reason
+	UploadFailed
+)
+
+// UploadEvent is sent by UploadFilesStreaming as each file is processed
+type UploadEvent struct {
+	Type             UploadEventType
+	OriginalFileName string
+	File             *UploadedFile
+	Err              error
+}
+
+// UploadFilesStreaming works like UploadFiles, but processes the files in the background
+// and reports progress on the returned channel, which is closed once every file is done.
+// A failing file doesn't stop the others. The channel must be drained before the handler
+// returns, since the server removes the parsed form files afterwards
+func (t *Tools) UploadFilesStreaming(r *http.Request, uploadDir string, rename ...bool) (<-chan UploadEvent, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	err := t.parseUploadForm(r, uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := t.uploadFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan UploadEvent)
+	batch := t.newUploadBatch(r.Context(), uploadDir, renameFile)
+
+	go func() {
+		defer close(events)
+
+		for field, fHeaders := range fields {
+			for _, hdr := range fHeaders {
+				events <- UploadEvent{Type: UploadStarted, OriginalFileName: hdr.Filename}
+
+				uploadedFile, err := t.saveUploadedFile(batch, field, hdr)
+				if err != nil {
+					events <- UploadEvent{Type: UploadFailed, OriginalFileName: hdr.Filename, Err: err}
+					continue
+				}
+
+				events <- UploadEvent{Type: UploadCompleted, OriginalFileName: hdr.Filename, File: uploadedFile}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// ErrUnexpectedUploadField is returned when RejectUnexpectedUploadFields is set and a
+// request contains files outside of UploadFieldName
+var ErrUnexpectedUploadField = errors.New("the request contains files in an unexpected field")
+
+// uploadFields returns the files of the parsed form of r to be saved, restricted to
+// UploadFieldName when it is set
+func (t *Tools) uploadFields(r *http.Request) (map[string][]*multipart.FileHeader, error) {
+	if t.UploadFieldName == "" {
+		return r.MultipartForm.File, nil
+	}
+
+	for field := range r.MultipartForm.File {
+		if field != t.UploadFieldName && t.RejectUnexpectedUploadFields {
+			return nil, fmt.Errorf("%w: %q", ErrUnexpectedUploadField, field)
+		}
+	}
+
+	fHeaders, ok := r.MultipartForm.File[t.UploadFieldName]
+	if !ok {
+		return nil, nil
+	}
+
+	return map[string][]*multipart.FileHeader{t.UploadFieldName: fHeaders}, nil
+}
+
+// sortedFields returns the names of the fields of a parsed form in order, since the form
+// doesn't keep the order they were sent in
+func sortedFields(fields map[string][]*multipart.FileHeader) []string {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ErrTooManyFiles is returned when an upload request contains more than MaxUploadCount files
+var ErrTooManyFiles = errors.New("the request contains too many files")
+
+// prepareUpload guards the body of r against slow clients and decompresses it when it
+// has a Content-Encoding
+func (t *Tools) prepareUpload(r *http.Request) error {
+	if t.MinUploadSpeed > 0 {
+		window := defaultMinUploadSpeedWindow
+		if t.MinUploadSpeedWindow != 0 {
+			window = t.MinUploadSpeedWindow
+		}
+		r.Body = newMinSpeedReader(r.Body, t.MinUploadSpeed, window)
+	}
+
+	return t.decodeUploadBody(r)
+}
+
+// ErrUnsupportedEncoding is returned when the body of an upload request is compressed
+// with something else than gzip or deflate
+var ErrUnsupportedEncoding = errors.New("the request body encoding is not supported")
+
+// UnsupportedEncodingError names the Content-Encoding of an upload request which can't be
+// decoded. It matches ErrUnsupportedEncoding with errors.Is
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrUnsupportedEncoding, e.Encoding)
+}
+
+func (e *UnsupportedEncodingError) Unwrap() error {
+	return ErrUnsupportedEncoding
+}
+
+// decodeUploadBody replaces a gzip or deflate compressed body of r with the decompressed
+// one. Besides the checks of every file against MaxFileSize, the decompressed body may not
+// be larger than MaxTotalUploadSize, or MaxFileSize when it isn't set, plus the room given
+// to the form fields, so a small compressed body can't expand without bounds
+func (t *Tools) decodeUploadBody(r *http.Request) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	var body io.Reader
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return fmt.Errorf("reading the gzip request body: %w", err)
+		}
+		body = zr
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return fmt.Errorf("reading the deflate request body: %w", err)
+		}
+		body = zr
+	default:
+		return &UnsupportedEncodingError{Encoding: encoding}
+	}
+
+	limit := t.MaxTotalUploadSize
+	if limit <= 0 {
+		limit = t.largestFileSize()
+	}
+	limit += maxFormValuesSize
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: &sizeCheckReader{r: body, max: limit, tooBig: func(int64) error {
+			return fmt.Errorf("%w: the decompressed request body is over %d bytes", ErrFileTooBig, limit)
+		}},
+		Closer: r.Body,
+	}
+
+	// the body is decoded once, and its length isn't known anymore
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+
+	return nil
+}
+
+// uploadFormError converts an error reading a multipart body into the one returned to callers
+func uploadFormError(err error) error {
+	if errors.Is(err, ErrUploadTooSlow) {
+		return ErrUploadTooSlow
+	}
+	if errors.Is(err, ErrFileTooBig) {
+		return err
+	}
+
+	return errors.New("the uploaded file is too big")
+}
+
+// parseUploadForm parses the multipart form of r, checks the number of files it holds
+// and makes sure uploadDir, if any, exists
+func (t *Tools) parseUploadForm(r *http.Request, uploadDir string) error {
+	err := t.prepareUpload(r)
+	if err != nil {
+		return err
+	}
+
+	err = r.ParseMultipartForm(t.maxFileSize())
+	if err != nil {
+		return uploadFormError(err)
+	}
+
+	if t.MaxUploadCount > 0 {
+		count := 0
+		for _, fHeaders := range r.MultipartForm.File {
+			count += len(fHeaders)
+		}
+		if count > t.MaxUploadCount {
+			return fmt.Errorf("%w: got %d, the limit is %d", ErrTooManyFiles, count, t.MaxUploadCount)
+		}
+	}
+
+	if uploadDir == "" || t.Storage != nil {
+		return nil
+	}
+
+	return t.CreateDirIfNotExist(uploadDir)
+}
+
+// publicURL returns the URL of an uploaded file, at relativePath in the upload directory,
+// below PublicBaseURL, or an empty string
+func (t *Tools) publicURL(relativePath string) string {
+	if t.PublicBaseURL == "" {
+		return ""
+	}
+
+	segments := strings.Split(filepath.ToSlash(relativePath), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.TrimSuffix(t.PublicBaseURL, "/") + "/" + strings.Join(segments, "/")
+}
+
+// uploadSubdir returns the subdirectory of the upload directory the file named name is
+// saved in, following UploadPathLayout and then ShardUploads
+func (t *Tools) uploadSubdir(name string) string {
+	var subdir string
+	if t.UploadPathLayout != "" {
+		subdir = filepath.FromSlash(time.Now().Format(t.UploadPathLayout))
+	}
+
+	if t.ShardUploads > 0 {
+		// hashing spreads names evenly, whether random or chosen by clients
+		sum := sha256.Sum256([]byte(name))
+		digest := hex.EncodeToString(sum[:])
+		for i := 0; i < t.ShardUploads && i < len(digest)/2; i++ {
+			subdir = filepath.Join(subdir, digest[2*i:2*i+2])
+		}
+	}
+
+	return subdir
+}
+
+// extensionAllowed reports whether the content type registered for the extension of name,
+// by ExtensionContentTypes or the mime package, is one of the AllowedFileTypes
+func (t *Tools) extensionAllowed(name string) bool {
+	mediaType, ok := t.extensionContentType(filepath.Ext(name))
+	if !ok {
+		return false
+	}
+
+	for _, allowedType := range t.AllowedFileTypes {
+		allowed, _, _ := mime.ParseMediaType(allowedType)
+		if matchContentType(allowedType, mediaType) || allowed == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extensionContentType returns the media type, without parameters, of the extension ext.
+// ExtensionContentTypes takes precedence over the types registered in the mime package
+func (t *Tools) extensionContentType(ext string) (string, bool) {
+	if ext == "" {
+		return "", false
+	}
+	ext = strings.ToLower(ext)
+
+	contentType, ok := t.ExtensionContentTypes[ext]
+	if !ok {
+		contentType = mime.TypeByExtension(ext)
+	}
+	if contentType == "" {
+		return "", false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(contentType), true
+	}
+
+	return mediaType, true
+}
+
+// BlockedFileTypeError is returned when the detected type of a file is in DisallowedFileTypes.
+// It matches ErrFileTypeNotPermitted with errors.Is
+type BlockedFileTypeError struct {
+	FileName    string
+	ContentType string
+}
+
+func (e *BlockedFileTypeError) Error() string {
+	return fmt.Sprintf("%s: the file type %s is blocked", e.FileName, e.ContentType)
+}
+
+func (e *BlockedFileTypeError) Unwrap() error {
+	return ErrFileTypeNotPermitted
+}
+
+// ErrFileExtensionNotPermitted is returned when the extension of a file is not in AllowedFileExtensions
+var ErrFileExtensionNotPermitted = errors.New("the uploaded file extension is not permitted")
+
+// fileExtensionAllowed reports whether the extension of name is in AllowedFileExtensions,
+// whose entries may omit the leading dot
+func (t *Tools) fileExtensionAllowed(name string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	if ext == "" {
+		return false
+	}
+
+	for _, allowed := range t.AllowedFileExtensions {
+		if strings.EqualFold(strings.TrimPrefix(allowed, "."), ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// generateFileName returns the name a renamed upload is saved under, produced by RenameFunc
+// when set or following RenameStrategy otherwise
+func (t *Tools) generateFileName(originalName string) string {
+	if t.RenameFunc != nil {
+		// the name must stay inside the upload directory
+		name := strings.NewReplacer("/", "_", "\\", "_").Replace(t.RenameFunc(originalName))
+		if name != "" && name != "." && name != ".." {
+			return name
+		}
+	}
+
+	if t.RenameStrategy == RenameSlug {
+		ext := filepath.Ext(originalName)
+		slug, err := t.Slugify(strings.TrimSuffix(originalName, ext))
+		if err == nil {
+			return fmt.Sprintf("%s-%s%s", slug, strings.ToLower(t.RandomString(6)), strings.ToLower(ext))
+		}
+	}
+
+	return fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(originalName))
+}
+
+// RenameStrategy decides how renamed uploads are named when RenameFunc isn't set
+type RenameStrategy int
+
+const (
+	// RenameRandom names files with 25 random characters and their original extension
+	RenameRandom RenameStrategy = iota
+	// RenameSlug names files with the slug of their original name, a short random suffix
+	// and their lowercased extension, like quarterly-report-x7ab2f.pdf. Names without any
+	// usable character fall back to RenameRandom
+	RenameSlug
+)
+
+// ErrInvalidFileName is returned when nothing usable remains of a file name once sanitized
+var ErrInvalidFileName = errors.New("the uploaded file name is invalid")
+
+// FileNameRejectedError is returned when FileNameValidator rejects the name of a file, and
+// wraps the error it returned. It also matches ErrInvalidFileName with errors.Is
+type FileNameRejectedError struct {
+	FileName string
+	Err      error
+}
+
+func (e *FileNameRejectedError) Error() string {
+	return fmt.Sprintf("%s: %q: %s", ErrInvalidFileName, e.FileName, e.Err)
+}
+
+func (e *FileNameRejectedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FileNameRejectedError) Is(target error) bool {
+	return target == ErrInvalidFileName
+}
+
+// decodeFileName turns the file name sent by a client into the readable name. The RFC 2231
+// filename* parameter is already decoded by mime/multipart, names sent as RFC 2047 encoded
+// words are decoded here. Invalid UTF-8 is replaced and the name is normalized to NFC,
+// so the same name typed on different systems is stored the same way, e.g. names from
+// macOS which stores them decomposed
+func decodeFileName(name string) string {
+	if strings.HasPrefix(name, "=?") {
+		var dec mime.WordDecoder
+		if decoded, err := dec.DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+
+	name = strings.ToValidUTF8(name, "\uFFFD")
+
+	return norm.NFC.String(name)
+}
+
+// windowsReservedNames are device names Windows doesn't allow as file names, with or
+// without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName makes a client supplied file name safe to write to disk: only its last
+// path component is kept, control characters and characters invalid on common filesystems
+// are removed, whitespace is collapsed and Windows device names get a leading underscore.
+// The length is checked by limitFileNameLength
+func sanitizeFileName(original string) (string, error) {
+	// clients on Windows may send backslash separated paths
+	name := strings.ReplaceAll(original, "\\", "/")
+	name = path.Base(name)
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+
+	// Windows ignores trailing dots and spaces
+	name = strings.TrimRight(name, ". ")
+	if name == "" || name == "/" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFileName, original)
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = "_" + name
+	}
+
+	return name, nil
+}
+
+// ErrFileNameTooLong is returned when the name of an uploaded file is longer than
+// MaxFileNameLength and TruncateLongFileNames is not set
+var ErrFileNameTooLong = errors.New("the uploaded file name is too long")
+
+// limitFileNameLength checks name against MaxFileNameLength, truncating it while
+// keeping its extension when TruncateLongFileNames is set
+func (t *Tools) limitFileNameLength(name string) (string, error) {
+	maxLength := defaultMaxFileNameLength
+	if t.MaxFileNameLength > 0 {
+		maxLength = t.MaxFileNameLength
+	}
+
+	if len(name) <= maxLength {
+		return name, nil
+	}
+
+	if !t.TruncateLongFileNames {
+		return "", ErrFileNameTooLong
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= maxLength {
+		// an absurdly long extension can't be kept
+		ext = ""
+	}
+
+	base := strings.TrimSuffix(name, ext)[:maxLength-len(ext)]
+	// don't cut a multi-byte character in half
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+
+	return base + ext, nil
+}
+
+// uploadBatch holds the state shared by all the files of a single upload request
+type uploadBatch struct {
+	ctx        context.Context
+	uploadDir  string
+	renameFile bool
+	// continueOnError is ContinueOnUploadError, always set when validating
+	continueOnError bool
+	// storage is where the files are written
+	storage FileStorage
+	// validating is set by ValidateFiles, which collects results instead of keeping files
+	validating bool
+	results    []*UploadValidationResult
+	// mu guards names, reserved and written, which concurrent uploads share
+	mu sync.Mutex
+	// names holds the file names already written by this batch
+	names map[string]bool
+	// reserved holds the paths resolveCollision picked for files being saved
+	reserved map[string]bool
+	// written is the number of bytes of the files saved by this batch
+	written int64
+	// dirSizes are the sizes of the upload directories before the batch, once measured
+	dirSizes map[string]int64
+	// request is the request of UploadFiles, given to UploadDirFunc
+	request *http.Request
+}
+
+func (t *Tools) newUploadBatch(ctx context.Context, uploadDir string, renameFile bool) *uploadBatch {
+	return &uploadBatch{
+		ctx:             ctx,
+		uploadDir:       uploadDir,
+		renameFile:      renameFile,
+		continueOnError: t.ContinueOnUploadError,
+		storage:         t.storage(uploadDir),
+		names:           make(map[string]bool),
+	}
+}
+
+// addWritten adds delta to the number of bytes written by the batch and returns the total
+func (b *uploadBatch) addWritten(delta int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.written += delta
+	return b.written
+}
+
+// localDir returns the directory files are saved in, when the batch saves them on disk
+func (b *uploadBatch) localDir() (string, bool) {
+	local, ok := b.storage.(*LocalStorage)
+	if !ok {
+		return "", false
+	}
+
+	return local.Dir, true
+}
+
+// DuplicatePolicy decides what happens when several files of one request would be
+// saved under the same name, which can only happen when they are not renamed
+type DuplicatePolicy int
+
+const (
+	// DuplicateOverwrite lets later files overwrite earlier ones
+	DuplicateOverwrite DuplicatePolicy = iota
+	// DuplicateError rejects later files with ErrDuplicateFileName
+	DuplicateError
+	// DuplicateSuffix saves later files as name-1.ext, name-2.ext and so on
+	DuplicateSuffix
+)
+
+// ErrDuplicateFileName is returned when a request contains the same file name twice
+// and Tools.DuplicateFileNames is DuplicateError
+var ErrDuplicateFileName = errors.New("the request contains more than one file with the same name")
+
+// uniqueName applies Tools.DuplicateFileNames to name and records the result in the batch
+func (t *Tools) uniqueName(batch *uploadBatch, name string) (string, error) {
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	if batch.names[name] {
+		switch t.DuplicateFileNames {
+		case DuplicateError:
+			return "", ErrDuplicateFileName
+		case DuplicateSuffix:
+			ext := filepath.Ext(name)
+			base := strings.TrimSuffix(name, ext)
+			for i := 1; batch.names[name]; i++ {
+				name = fmt.Sprintf("%s-%d%s", base, i, ext)
+			}
+		}
+	}
+	batch.names[name] = true
+
+	return name, nil
+}
+
+// CollisionPolicy decides what happens when an upload would be saved under the name of
+// a file already in the upload directory
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite replaces the existing file
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionError rejects the upload with ErrFileExists, leaving the existing file untouched
+	CollisionError
+	// CollisionAutoSuffix saves the upload as name-1.ext, name-2.ext and so on
+	CollisionAutoSuffix
+)
+
+// ErrFileExists is returned when CollisionPolicy is CollisionError and a file with the
+// name of an upload already exists
+var ErrFileExists = errors.New("a file with the same name already exists")
+
+// resolveCollision applies CollisionPolicy to name, a file about to be saved in uploadDir.
+// The name chosen is reserved in batch until the file is saved, so the files saved
+// concurrently by UploadConcurrency workers don't pick the same one
+func (t *Tools) resolveCollision(batch *uploadBatch, uploadDir, name string) (string, error) {
+	if t.CollisionPolicy == CollisionOverwrite {
+		return name, nil
+	}
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	taken := func(name string) bool {
+		path := filepath.Join(uploadDir, name)
+		return batch.reserved[path] || fileExists(path)
+	}
+	reserve := func(name string) (string, error) {
+		if batch.reserved == nil {
+			batch.reserved = make(map[string]bool)
+		}
+		batch.reserved[filepath.Join(uploadDir, name)] = true
+		return name, nil
+	}
+
+	if !taken(name) {
+		return reserve(name)
+	}
+
+	if t.CollisionPolicy == CollisionError {
+		return "", fmt.Errorf("%w: %q", ErrFileExists, name)
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if !taken(candidate) {
+			return reserve(candidate)
+		}
+	}
+}
+
+// releaseName frees a name reserved by resolveCollision for a file which wasn't saved
+func (b *uploadBatch) releaseName(path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.reserved, path)
+}
+
+// fileExists reports whether anything, even a broken symlink, exists at path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// ErrFileTypeNotPermitted is returned when the detected type of a file is not in AllowedFileTypes
+var ErrFileTypeNotPermitted = errors.New("the uploaded file type is not permitted")
+
+// matchContentType reports whether the detected content type matches pattern, which is
+// either an exact type or a type whose subtype contains wildcards, like "image/*".
+// The comparison is case-insensitive
+func matchContentType(pattern, contentType string) bool {
+	if strings.EqualFold(pattern, contentType) {
+		return true
+	}
+
+	pattern = strings.ToLower(pattern)
+	patternType, patternSubtype, ok := strings.Cut(pattern, "/")
+	if !ok || patternType == "" || strings.Contains(patternType, "*") || !strings.Contains(patternSubtype, "*") {
+		return false
+	}
+
+	// wildcards ignore parameters like charset
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	fileType, fileSubtype, _ := strings.Cut(mediaType, "/")
+	if fileType != patternType {
+		return false
+	}
+
+	matched, err := path.Match(patternSubtype, fileSubtype)
+
+	return err == nil && matched
+}
+
+// ErrContentTypeMismatch is returned when StrictContentType is set and the Content-Type
+// declared for an uploaded file is missing or doesn't match its detected content type
+var ErrContentTypeMismatch = errors.New("the declared content type doesn't match the content")
+
+// checkDeclaredType makes sure declared, the Content-Type of the part of fileName, is the
+// detected type, ignoring parameters like charset, and is in AllowedFileTypes. A declared
+// type without parameters is allowed by an entry with parameters, like text/plain by
+// text/plain; charset=utf-8
+func (t *Tools) checkDeclaredType(fileName, declared, detected string) error {
+	if declared == "" {
+		return fmt.Errorf("%w: %q has no Content-Type, its content is %s", ErrContentTypeMismatch, fileName, detected)
+	}
+
+	declaredType, _, err := mime.ParseMediaType(declared)
+	detectedType, _, _ := mime.ParseMediaType(detected)
+	if err != nil || declaredType != detectedType {
+		return fmt.Errorf("%w: %q is declared as %s but its content is %s", ErrContentTypeMismatch, fileName, declared, detected)
+	}
+
+	if len(t.AllowedFileTypes) == 0 {
+		return nil
+	}
+	for _, a := range t.AllowedFileTypes {
+		allowedType, _, _ := mime.ParseMediaType(a)
+		if matchContentType(a, declared) || allowedType == strings.ToLower(declared) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q is declared as %s, which is not in AllowedFileTypes, its content is %s", ErrFileTypeNotPermitted, fileName, declared, detected)
+}
+
+// ErrExtensionMismatch is returned when RequireExtensionMatch is set and the extension
+// of an uploaded file doesn't match its detected content type
+var ErrExtensionMismatch = errors.New("the file extension doesn't match its content")
+
+// checkExtensionMatch makes sure the extension of name is registered for contentType
+func (t *Tools) checkExtensionMatch(name, contentType string) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return fmt.Errorf("%w: %q has no extension, its content is %s", ErrExtensionMismatch, name, contentType)
+	}
+
+	expected, ok := t.extensionContentType(ext)
+	if !ok {
+		return fmt.Errorf("%w: %q has the unknown extension %s, its content is %s", ErrExtensionMismatch, name, ext, contentType)
+	}
+
+	// parameters like charset are ignored
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	if !strings.EqualFold(expected, mediaType) {
+		return fmt.Errorf("%w: %q has the extension %s but its content is %s", ErrExtensionMismatch, name, ext, contentType)
+	}
+
+	return nil
+}
+
+// ErrFileTooSmall is returned when an uploaded file is empty or smaller than MinFileSize
+var ErrFileTooSmall = errors.New("the uploaded file is too small")
+
+// fileTooSmallError names the file which is smaller than MinFileSize
+func (t *Tools) fileTooSmallError(name string, size int64) error {
+	return fmt.Errorf("%w: %q is %d bytes, the minimum is %d", ErrFileTooSmall, name, size, t.MinFileSize)
+}
+
+// ErrTotalSizeExceeded is returned when the files of one request add up to more than
+// MaxTotalUploadSize
+var ErrTotalSizeExceeded = errors.New("the uploaded files are too big in total")
+
+// TotalSizeExceededError reports how many bytes of files were accepted before
+// MaxTotalUploadSize was reached. It matches ErrTotalSizeExceeded with errors.Is
+type TotalSizeExceededError struct {
+	Accepted int64
+	Limit    int64
+}
+
+func (e *TotalSizeExceededError) Error() string {
+	return fmt.Sprintf("%s: %d bytes were accepted, the limit is %d", ErrTotalSizeExceeded, e.Accepted, e.Limit)
+}
+
+func (e *TotalSizeExceededError) Unwrap() error {
+	return ErrTotalSizeExceeded
+}
+
+// ErrFileTooBig is returned when a single uploaded file is larger than MaxFileSize
+var ErrFileTooBig = errors.New("the uploaded file is too big")
+
+// fileTooBigError names the file which exceeded MaxFileSize, or the largest limit of
+// MaxFileSizeByType when its type isn't known yet
+func (t *Tools) fileTooBigError(name string, size int64) error {
+	return fmt.Errorf("%w: %q is %d bytes, the limit is %d", ErrFileTooBig, name, size, t.largestFileSize())
+}
+
+// maxFileSize returns MaxFileSize, or defaultMaxFileSize when it isn't set. The default is
+// not stored in t, which may be shared by concurrent uploads
+func (t *Tools) maxFileSize() int64 {
+	if t.MaxFileSize == 0 {
+		return defaultMaxFileSize
+	}
+
+	return t.MaxFileSize
+}
+
+// largestFileSize is the size no file may exceed whatever its type, the largest of
+// MaxFileSize and the limits of MaxFileSizeByType
+func (t *Tools) largestFileSize() int64 {
+	largest := t.maxFileSize()
+	for _, limit := range t.MaxFileSizeByType {
+		if limit > largest {
+			largest = limit
+		}
+	}
+
+	return largest
+}
+
+// fileSizeLimit returns the size limit of files of contentType and the MaxFileSizeByType
+// entry it comes from, empty when it is MaxFileSize. The longest matching wildcard is used
+// when there is no exact entry, so the choice doesn't depend on the map order
+func (t *Tools) fileSizeLimit(contentType string) (int64, string) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	match := ""
+	for pattern := range t.MaxFileSizeByType {
+		if strings.EqualFold(pattern, contentType) || strings.EqualFold(pattern, mediaType) {
+			return t.MaxFileSizeByType[pattern], pattern
+		}
+		if matchContentType(pattern, contentType) && (len(pattern) > len(match) || len(pattern) == len(match) && pattern < match) {
+			match = pattern
+		}
+	}
+
+	if match == "" {
+		return t.maxFileSize(), ""
+	}
+	return t.MaxFileSizeByType[match], match
+}
+
+// fileSizeLimitError names the file which exceeded the limit of its type
+func fileSizeLimitError(name string, size, limit int64, pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("%w: %q is %d bytes, the MaxFileSize limit is %d", ErrFileTooBig, name, size, limit)
+	}
+	return fmt.Errorf("%w: %q is %d bytes, the MaxFileSizeByType limit for %s is %d", ErrFileTooBig, name, size, pattern, limit)
+}
+
+// saveUploadedFile checks the type of the file in hdr, sent in the form field named field,
+// and writes it to uploadDir
+func (t *Tools) saveUploadedFile(batch *uploadBatch, field string, hdr *multipart.FileHeader) (*UploadedFile, error) {
+	if hdr.Size > t.largestFileSize() {
+		return nil, t.fileTooBigError(hdr.Filename, hdr.Size)
+	}
+
+	infile, err := hdr.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+
+	return t.saveFile(batch, field, hdr.Filename, hdr.Header, hdr.Size, infile)
+}
+
+// saveFile checks the type of the file named fileName, sent in the form field named field,
+// and copies it from src to uploadDir. src is read only once, so it can be a multipart stream.
+// header is the header of the multipart part, nil when the file wasn't sent in a form, and
+// size is the length of the file when known beforehand, -1 otherwise
+func (t *Tools) saveFile(batch *uploadBatch, field, fileName string, header textproto.MIMEHeader, size int64, src io.Reader) (*UploadedFile, error) {
+	var uploadedFile UploadedFile
+	fileName = decodeFileName(fileName)
+
+	// sample the first bytes, or the whole file when it is smaller
+	sniffSize := t.SniffSize
+	if sniffSize <= 0 {
+		sniffSize = 512
+	}
+	buff := make([]byte, sniffSize)
+	n, err := io.ReadFull(src, buff)
+	if err == io.EOF {
+		return nil, t.fileTooSmallError(fileName, 0)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	buff = buff[:n]
+
+	// the sampled bytes are put back in front of the rest of the file
+	body := io.MultiReader(bytes.NewReader(buff), src)
+
+	// check to see if the file type is permitted
+	fileType := ""
+	if t.ContentTypeDetector != nil {
+		fileType = t.ContentTypeDetector(fileName, buff)
+	}
+	if fileType == "" {
+		fileType = http.DetectContentType(buff)
+	}
+	allowedTypes := t.AllowedFileTypes
+
+	// deny wins over allow
+	for _, d := range t.DisallowedFileTypes {
+		if matchContentType(d, fileType) {
+			return nil, &BlockedFileTypeError{FileName: fileName, ContentType: fileType}
+		}
+	}
+
+	// without any list everything is rejected, so the types or extensions have to be configured explicitly
+	if len(allowedTypes) == 0 && len(t.AllowedFileExtensions) == 0 && len(t.DisallowedFileTypes) == 0 {
+		return nil, fmt.Errorf("%w: no file types are allowed, configure AllowedFileTypes", ErrFileTypeNotPermitted)
+	}
+
+	if len(allowedTypes) > 0 {
+		allowed := false
+		for _, a := range allowedTypes {
+			if matchContentType(a, fileType) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return nil, fmt.Errorf("%w: %q is %s, which is not in AllowedFileTypes", ErrFileTypeNotPermitted, fileName, fileType)
+		}
+	}
+
+	if t.StrictContentType && header != nil {
+		err = t.checkDeclaredType(fileName, header.Get("Content-Type"), fileType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(t.AllowedFileExtensions) > 0 && !t.fileExtensionAllowed(fileName) {
+		return nil, fmt.Errorf("%w: the extension of %q is not in AllowedFileExtensions", ErrFileExtensionNotPermitted, fileName)
+	}
+
+	if t.InferAllowedExtensions && !t.extensionAllowed(fileName) {
+		return nil, fmt.Errorf("%w: the extension of %q doesn't match the allowed file types", ErrFileExtensionNotPermitted, fileName)
+	}
+
+	if t.RequireExtensionMatch {
+		err = t.checkExtensionMatch(fileName, fileType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the limit depends on the detected type, and a known size is checked before reading
+	sizeLimit, sizeLimitType := t.fileSizeLimit(fileType)
+	if size > sizeLimit {
+		return nil, fileSizeLimitError(fileName, size, sizeLimit, sizeLimitType)
+	}
+
+	storage := batch.storage
+	dir, local := batch.localDir()
+	routed := t.UploadDirFunc != nil && batch.request != nil && local
+	if routed {
+		dir, err = t.UploadDirFunc(batch.request, field, fileType)
+		if err != nil {
+			return nil, err
+		}
+		err = t.CreateDirIfNotExist(dir)
+		if err != nil {
+			return nil, err
+		}
+		storage = &LocalStorage{Dir: dir, Tools: t}
+	}
+
+	if strings.HasPrefix(fileType, "image/") {
+		// only the header is decoded, and what the decoder reads is kept so it can be written too
+		var head bytes.Buffer
+		config, _, decodeErr := image.DecodeConfig(io.TeeReader(body, &head))
+		body = io.MultiReader(&head, body)
+
+		// a format which can't be decoded has nothing to check
+		if decodeErr == nil {
+			uploadedFile.ImageWidth, uploadedFile.ImageHeight = config.Width, config.Height
+
+			err = t.checkImageDimensions(fileName, config)
+			if err != nil {
+				return nil, err
+			}
+
+			if t.RequiredAspectRatio != nil {
+				err = t.checkAspectRatio(config)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	convertedExt := ""
+	if t.ConvertImagesTo != "" && strings.HasPrefix(fileType, "image/") {
+		body, fileType, convertedExt, err = t.convertImage(fileName, body, sizeLimit, sizeLimitType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if batch.renameFile {
+		uploadedFile.NewFileName = t.generateFileName(fileName)
+	} else {
+		uploadedFile.NewFileName, err = sanitizeFileName(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if convertedExt != "" {
+		uploadedFile.NewFileName = strings.TrimSuffix(uploadedFile.NewFileName, filepath.Ext(uploadedFile.NewFileName)) + convertedExt
+	}
+
+	uploadedFile.NewFileName, err = t.limitFileNameLength(uploadedFile.NewFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !batch.renameFile && t.FileNameValidator != nil {
+		err = t.FileNameValidator(uploadedFile.NewFileName)
+		if err != nil {
+			return nil, &FileNameRejectedError{FileName: uploadedFile.NewFileName, Err: err}
+		}
+	}
+
+	uploadedFile.NewFileName, err = t.uniqueName(batch, uploadedFile.NewFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the layout and shard subdirectories, if any, are where the file goes
+	subdir := t.uploadSubdir(uploadedFile.NewFileName)
+	if local {
+		// other storages deal with names already taken themselves
+		uploadedFile.NewFileName, err = t.resolveCollision(batch, filepath.Join(dir, subdir), uploadedFile.NewFileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uploadedFile.OriginalFileName = fileName
+	uploadedFile.ContentType = fileType
+	uploadedFile.FieldName = field
+
+	release, err := t.acquireUploadSlot(batch.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if t.StripEXIF && fileType == "image/jpeg" {
+		pr, pw := io.Pipe()
+		// stops the goroutine when the copy ends early
+		defer pr.Close()
+		go func(src io.Reader) {
+			pw.CloseWithError(stripJPEGMetadata(pw, src))
+		}(body)
+		body = pr
+	}
+
+	// the size of a file isn't always known beforehand, so the limits are checked while
+	// it is read, failing the storage write once one is broken
+	sizeCheck := &sizeCheckReader{
+		r:   &contextReader{ctx: batch.ctx, r: body},
+		max: sizeLimit,
+		min: t.MinFileSize,
+		tooBig: func(n int64) error {
+			return fileSizeLimitError(fileName, n, sizeLimit, sizeLimitType)
+		},
+		tooSmall: func(n int64) error {
+			return t.fileTooSmallError(fileName, n)
+		},
+	}
+	var dirSize int64
+	if t.MaxDirBytes > 0 && local {
+		dirSize, err = t.batchDirSize(batch, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the bytes are counted as they are read, so files saved concurrently can't go over
+	// MaxTotalUploadSize or MaxDirBytes together
+	sizeCheck.count = func(delta int64) error {
+		total := batch.addWritten(delta)
+		if t.MaxTotalUploadSize > 0 && total > t.MaxTotalUploadSize {
+			return &TotalSizeExceededError{Accepted: total - sizeCheck.n, Limit: t.MaxTotalUploadSize}
+		}
+		if t.MaxDirBytes > 0 && local && dirSize+total > t.MaxDirBytes {
+			return fmt.Errorf("%w: %q doesn't fit in the %d bytes left", ErrQuotaExceeded, fileName, t.MaxDirBytes-dirSize-(total-sizeCheck.n))
+		}
+		return nil
+	}
+	body = sizeCheck
+
+	if t.ValidatePDFs && fileType == "application/pdf" {
+		body = &pdfCheckReader{r: body, rejectEncrypted: t.RejectEncryptedPDFs}
+	}
+
+	if t.UploadScanner != nil {
+		scanner := t.newScanReader(fileName, body)
+		defer scanner.close()
+		body = scanner
+	}
+
+	if t.OnUploadProgress != nil {
+		body = &progressReader{r: body, report: func(copied int64) {
+			t.reportProgress(fileName, copied, size)
+		}}
+	}
+
+	uploadedFile.RelativePath = filepath.Join(subdir, uploadedFile.NewFileName)
+
+	var fileSize int64
+	if t.DeduplicateUploads && local {
+		reserved := filepath.Join(dir, uploadedFile.RelativePath)
+		fileSize, err = t.saveDeduplicated(batch.ctx, storage, dir, &uploadedFile, body)
+		if err == nil && uploadedFile.Duplicate {
+			// the name reserved for the upload isn't used
+			batch.releaseName(reserved)
+		}
+	} else {
+		fileSize, err = storage.Save(batch.ctx, filepath.ToSlash(uploadedFile.RelativePath), body)
+	}
+	if err != nil {
+		// a file which isn't kept doesn't count toward MaxTotalUploadSize
+		batch.addWritten(-sizeCheck.n)
+		if local {
+			batch.releaseName(filepath.Join(dir, uploadedFile.RelativePath))
+		}
+		return nil, err
+	}
+
+	uploadedFile.FileSize = fileSize
+	// PublicBaseURL serves the upload directory, not those chosen by UploadDirFunc
+	if !routed {
+		uploadedFile.URL = t.publicURL(uploadedFile.RelativePath)
+	}
+
+	// only files on disk have a path, and thumbnails are written next to them
+	if local {
+		// a duplicate takes no more room in the directory
+		if !uploadedFile.Duplicate {
+			t.addDirSize(dir, fileSize)
+		}
+		uploadedFile.UploadDir = dir
+		uploadedFile.FullPath = filepath.Join(dir, uploadedFile.RelativePath)
+
+		if t.Thumbnail != nil && !uploadedFile.Duplicate && strings.HasPrefix(fileType, "image/") {
+			// the upload itself succeeded, so a failure is only reported
+			uploadedFile.ThumbnailFileName, uploadedFile.ThumbnailErr = t.writeThumbnail(uploadedFile.FullPath)
+		}
+	}
+
+	if t.OnFileUploaded != nil && !batch.validating {
+		err = t.OnFileUploaded(&uploadedFile)
+		if err != nil {
+			t.discardUploadedFile(batch, &uploadedFile)
+			return nil, err
+		}
+	}
+
+	return &uploadedFile, nil
+}
+
+// discardUploadedFile removes a file saveFile saved and its thumbnail, and stops counting it
+// toward the upload limits
+func (t *Tools) discardUploadedFile(batch *uploadBatch, file *UploadedFile) {
+	if file.Duplicate {
+		return
+	}
+
+	batch.removeFiles([]*UploadedFile{file})
+	batch.addWritten(-file.FileSize)
+
+	if file.UploadDir != "" {
+		t.addDirSize(file.UploadDir, -file.FileSize)
+	}
+}
+
+// uploadIndexFileName is the file of the upload directory mapping checksums to the files
+// saved by DeduplicateUploads
+const uploadIndexFileName = ".upload-index.json"
+
+// uploadIndexMu serializes the updates of the index files, so concurrent uploads of the
+// same content can't both be kept or overwrite each other's entries
+var uploadIndexMu sync.Mutex
+
+// saveDeduplicated saves body to storage, the LocalStorage of dir, under file.RelativePath
+// unless the index of dir has a file with the same content, checked by hashing it again
+// since it may have been overwritten or changed. file then describes that file, marked
+// Duplicate, and nothing is saved: the content is hashed into a temporary file first so
+// a duplicate never reaches the upload directory. It returns the size of the file
+func (t *Tools) saveDeduplicated(ctx context.Context, storage FileStorage, dir string, file *UploadedFile, body io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	checksum := sha256.New()
+	_, err = copyUpload(io.MultiWriter(tmp, checksum), &contextReader{ctx: ctx, r: body}, t.CopyBufferSize)
+	if err != nil {
+		return 0, err
+	}
+	file.Checksum = hex.EncodeToString(checksum.Sum(nil))
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	uploadIndexMu.Lock()
+	defer uploadIndexMu.Unlock()
+
+	indexPath := filepath.Join(dir, uploadIndexFileName)
+	index := make(map[string]string)
+	data, err := os.ReadFile(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			return 0, fmt.Errorf("reading %s: %w", uploadIndexFileName, err)
+		}
+	}
+
+	existing, ok := index[file.Checksum]
+	// an entry whose file was deleted or changed since is replaced
+	if ok && fileChecksum(filepath.Join(dir, filepath.FromSlash(existing))) == file.Checksum {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(existing)))
+		if err != nil {
+			return 0, err
+		}
+
+		file.RelativePath = filepath.FromSlash(existing)
+		file.NewFileName = filepath.Base(file.RelativePath)
+		file.Duplicate = true
+		return info.Size(), nil
+	}
+
+	name := filepath.ToSlash(file.RelativePath)
+	size, err := storage.Save(ctx, name, tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	// the file may have overwritten one the index points at, whose content is gone
+	for checksum, path := range index {
+		if path == name {
+			delete(index, checksum)
+		}
+	}
+	index[file.Checksum] = name
+
+	err = t.writeUploadIndex(indexPath, index)
+	if err != nil {
+		_ = storage.Remove(name)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// writeUploadIndex replaces the index file at indexPath in one step, so a crash can't
+// leave it half written
+func (t *Tools) writeUploadIndex(indexPath string, index map[string]string) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(indexPath), ".tmp-"+t.RandomString(16))
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, indexPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 of the file at path, or an empty string when it
+// can't be read
+func fileChecksum(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FileStorage is where the upload helpers write the files which passed every check.
+// Names are RelativePath with forward slashes. With UploadConcurrency several files are
+// saved at once, so Save and Remove must be safe for concurrent use
+type FileStorage interface {
+	// Save writes what is read from r under name and returns the number of bytes written.
+	// r fails when a limit is broken, and Save must then fail with an error wrapping the
+	// one of r, without keeping what it already wrote
+	Save(ctx context.Context, name string, r io.Reader) (int64, error)
+	// Remove deletes a saved file, which happens when the rest of its request is rejected
+	Remove(name string) error
+}
+
+// LocalStorage is the FileStorage saving files under Dir, used by the upload helpers with
+// the upload directory when Tools.Storage isn't set. Files are written atomically following
+// the UploadFileMode and CollisionPolicy of Tools, which defaults to a zero Tools
+type LocalStorage struct {
+	Dir   string
+	Tools *Tools
+}
+
+// Save writes r to a temporary file renamed to name once complete, creating the
+// directories name is in
+func (s *LocalStorage) Save(ctx context.Context, name string, r io.Reader) (int64, error) {
+	t := s.Tools
+	if t == nil {
+		t = &Tools{}
+	}
+
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	err := t.CreateDirIfNotExist(filepath.Dir(path))
+	if err != nil {
+		return 0, err
+	}
+
+	return t.writeFileAtomically(path, func(f *os.File) (int64, error) {
+		return copyUpload(f, &contextReader{ctx: ctx, r: r}, t.CopyBufferSize)
+	})
+}
+
+// Remove deletes the file saved under name
+func (s *LocalStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(s.Dir, filepath.FromSlash(name)))
+}
+
+// defaultCopyBufferSize is the size of the buffers of copyUpload when CopyBufferSize isn't set
+const defaultCopyBufferSize = 256 << 10 // 256 KB
+
+// copyBufferPool holds the buffers of copyUpload, so uploads don't allocate their own
+var copyBufferPool sync.Pool
+
+// copyUpload copies src to dst like io.Copy, with a buffer of size bytes from copyBufferPool
+func copyUpload(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+
+	buf, _ := copyBufferPool.Get().(*[]byte)
+	if buf == nil || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer copyBufferPool.Put(buf)
+
+	// *os.File implements io.ReaderFrom, which io.CopyBuffer would use instead of the buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// storage returns Tools.Storage, or a LocalStorage saving to uploadDir
+func (t *Tools) storage(uploadDir string) FileStorage {
+	if t.Storage != nil {
+		return t.Storage
+	}
+
+	return &LocalStorage{Dir: uploadDir, Tools: t}
+}
+
+// writeFileAtomically calls write with a temporary file created next to path with
+// UploadFileMode permissions, which is renamed to path once write succeeded and the
+// content is synced to disk, so a file only appears under its final name once complete.
+// The temporary file is removed on failure
+func (t *Tools) writeFileAtomically(path string, write func(f *os.File) (int64, error)) (int64, error) {
+	tmpPath := filepath.Join(filepath.Dir(path), ".tmp-"+t.RandomString(16))
+
+	mode := os.FileMode(0666)
+	if t.UploadFileMode != 0 {
+		mode = t.UploadFileMode
+	}
+
+	// like os.Create, the umask still applies to mode
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = t.moveUpload(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// moveUpload gives the complete upload at tmpPath its final path. Unless CollisionPolicy
+// is CollisionOverwrite, a file created at path in the meantime is left untouched
+func (t *Tools) moveUpload(tmpPath, path string) error {
+	if t.CollisionPolicy == CollisionOverwrite {
+		return os.Rename(tmpPath, path)
+	}
+
+	// unlike a rename, a link fails when path exists
+	err := os.Link(tmpPath, path)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %q", ErrFileExists, filepath.Base(path))
+		}
+		return err
+	}
+
+	return os.Remove(tmpPath)
+}
+
+// pdfEncryptMarker is the dictionary key present in encrypted PDFs
+var pdfEncryptMarker = []byte("/Encrypt")
+
+// pdfTailSize is how much of the end of a PDF is searched for the end of file marker,
+// which may be followed by a few line endings
+const pdfTailSize = 1024
+
+// pdfCheckReader is a lightweight check that the PDF read through it looks complete and,
+// when rejectEncrypted is set, that it isn't encrypted. The read reaching the end of an
+// invalid PDF fails
+type pdfCheckReader struct {
+	r               io.Reader
+	rejectEncrypted bool
+	head            []byte
+	// tail holds the last bytes read, enough to find the end of file marker and a
+	// marker split between two reads
+	tail      []byte
+	encrypted bool
+}
+
+func (c *pdfCheckReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+
+	if len(c.head) < 5 {
+		c.head = append(c.head, p[:n]...)
+	}
+
+	if c.rejectEncrypted && !c.encrypted {
+		overlap := len(pdfEncryptMarker) - 1
+		if len(c.tail) < overlap {
+			overlap = len(c.tail)
+		}
+		window := append(append([]byte{}, c.tail[len(c.tail)-overlap:]...), p[:n]...)
+		c.encrypted = bytes.Contains(window, pdfEncryptMarker)
+	}
+
+	c.tail = append(c.tail, p[:n]...)
+	if len(c.tail) > pdfTailSize {
+		c.tail = c.tail[len(c.tail)-pdfTailSize:]
+	}
+
+	if err == io.EOF {
+		if checkErr := c.check(); checkErr != nil {
+			return n, checkErr
+		}
+	}
+
+	return n, err
+}
+
+func (c *pdfCheckReader) check() error {
+	if len(c.head) < 5 || string(c.head[:5]) != "%PDF-" {
+		return errors.New("the uploaded PDF is malformed")
+	}
+
+	if !bytes.HasSuffix(bytes.TrimRight(c.tail, "\r\n \t\x00"), []byte("%%EOF")) {
+		return errors.New("the uploaded PDF is truncated")
+	}
+
+	if c.encrypted {
+		return errors.New("encrypted PDFs are not permitted")
+	}
+
+	return nil
+}
+
+// sizeCheckReader fails the read going over max, and the one reaching the end of a file
+// smaller than min, so storages never keep a file breaking the size limits
+type sizeCheckReader struct {
+	r        io.Reader
+	n        int64
+	max      int64
+	min      int64
+	tooBig   func(n int64) error
+	tooSmall func(n int64) error
+	// count, when set, is called with the number of bytes of every read and can fail it
+	count func(delta int64) error
+}
+
+func (s *sizeCheckReader) Read(p []byte) (int, error) {
+	// one byte more than allowed is enough to know the limit is exceeded
+	if room := s.max - s.n + 1; int64(len(p)) > room {
+		p = p[:room]
+	}
+
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if s.n > s.max {
+		return n, s.tooBig(s.n)
+	}
+	if s.count != nil && n > 0 {
+		if countErr := s.count(int64(n)); countErr != nil {
+			return n, countErr
+		}
+	}
+	if err == io.EOF && s.n < s.min {
+		return n, s.tooSmall(s.n)
+	}
+
+	return n, err
+}
+
+// AspectRatio describes a required width:height ratio for uploaded images.
+// Tolerance is the allowed relative difference, e.g. 0.01 for 1%
+type AspectRatio struct {
+	Width     int
+	Height    int
+	Tolerance float64
+}
+
+// ErrImageTooLarge is returned when an uploaded image is wider than MaxImageWidth or
+// higher than MaxImageHeight
+var ErrImageTooLarge = errors.New("the uploaded image is too large")
+
+// checkImageDimensions compares the dimensions of the image named name to MaxImageWidth
+// and MaxImageHeight
+func (t *Tools) checkImageDimensions(name string, config image.Config) error {
+	if (t.MaxImageWidth > 0 && config.Width > t.MaxImageWidth) || (t.MaxImageHeight > 0 && config.Height > t.MaxImageHeight) {
+		return fmt.Errorf("%w: %q is %dx%d", ErrImageTooLarge, name, config.Width, config.Height)
+	}
+
+	return nil
+}
+
+// checkDecodePixels reads the header of the image named name from r and makes sure it has
+// no more than MaxDecodePixels pixels, so decoding it can't take too much memory. An image
+// whose header can't be read is left to the decoder to reject
+func (t *Tools) checkDecodePixels(name string, r io.Reader) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil
+	}
+
+	limit := t.MaxDecodePixels
+	if limit <= 0 {
+		limit = defaultMaxDecodePixels
+	}
+	if int64(config.Width)*int64(config.Height) > limit {
+		return fmt.Errorf("%w: %q is %dx%d, more than the %d pixels which can be decoded", ErrImageTooLarge, name, config.Width, config.Height, limit)
+	}
+
+	return nil
+}
+
+// checkAspectRatio compares the ratio of the image described by config to RequiredAspectRatio
+func (t *Tools) checkAspectRatio(config image.Config) error {
+	required := t.RequiredAspectRatio
+	if required.Width <= 0 || required.Height <= 0 || config.Height == 0 {
+		return errors.New("invalid aspect ratio")
+	}
+
+	want := float64(required.Width) / float64(required.Height)
+	got := float64(config.Width) / float64(config.Height)
+
+	if math.Abs(got-want)/want > required.Tolerance {
+		return fmt.Errorf("the uploaded image is %dx%d, which is not the required %d:%d aspect ratio", config.Width, config.Height, required.Width, required.Height)
+	}
+
+	return nil
+}
+
+// stripJPEGMetadata copies the JPEG from src to dst without its APP1 segments, which hold
+// the EXIF and XMP metadata like GPS coordinates and device information
+func stripJPEGMetadata(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return errors.New("the uploaded JPEG is malformed")
+	}
+	if _, err := dst.Write(soi); err != nil {
+		return err
+	}
+
+	for {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(br, marker); err != nil || marker[0] != 0xFF {
+			return errors.New("the uploaded JPEG is malformed")
+		}
+
+		// markers without a length
+		if marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD9) {
+			if _, err := dst.Write(marker); err != nil {
+				return err
+			}
+			if marker[1] == 0xD9 {
+				return nil
+			}
+			continue
+		}
+
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(br, length); err != nil {
+			return errors.New("the uploaded JPEG is malformed")
+		}
+		size := int64(length[0])<<8 | int64(length[1]) - 2
+		if size < 0 {
+			return errors.New("the uploaded JPEG is malformed")
+		}
+
+		if marker[1] == 0xE1 {
+			if _, err := io.CopyN(io.Discard, br, size); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := dst.Write(append(marker, length...)); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, br, size); err != nil {
+			return err
+		}
+
+		// the compressed image data follows the start of scan, there is no metadata past it
+		if marker[1] == 0xDA {
+			_, err := io.Copy(dst, br)
+			return err
+		}
+	}
+}
+
+// ImageConversionError is returned when an uploaded image can't be converted to ConvertImagesTo
+type ImageConversionError struct {
+	FileName string
+	Err      error
+}
+
+func (e *ImageConversionError) Error() string {
+	return fmt.Sprintf("%s: converting the image failed: %s", e.FileName, e.Err)
+}
+
+func (e *ImageConversionError) Unwrap() error {
+	return e.Err
+}
+
+// convertImage re-encodes the image read from src to ConvertImagesTo and returns the
+// encoded image with its content type and extension. The whole image is held in memory,
+// so no more than limit bytes are read, the size limit of the image from limitType
+func (t *Tools) convertImage(fileName string, src io.Reader, limit int64, limitType string) (io.Reader, string, string, error) {
+	data, err := io.ReadAll(io.LimitReader(src, limit+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", "", fileSizeLimitError(fileName, int64(len(data)), limit, limitType)
+	}
+
+	err = t.checkDecodePixels(fileName, bytes.NewReader(data))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// gif.Decode returns the first frame of an animation
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", "", &ImageConversionError{FileName: fileName, Err: err}
+	}
+
+	var out bytes.Buffer
+	switch t.ConvertImagesTo {
+	case "jpeg":
+		// jpeg has no alpha channel, transparent pixels would turn black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&out, flat, &jpeg.Options{Quality: 85})
+		if err != nil {
+			return nil, "", "", &ImageConversionError{FileName: fileName, Err: err}
+		}
+		return &out, "image/jpeg", ".jpg", nil
+	case "png":
+		err = png.Encode(&out, img)
+		if err != nil {
+			return nil, "", "", &ImageConversionError{FileName: fileName, Err: err}
+		}
+		return &out, "image/png", ".png", nil
+	default:
+		return nil, "", "", &ImageConversionError{FileName: fileName, Err: fmt.Errorf("unsupported format %q", t.ConvertImagesTo)}
+	}
+}
+
+// ThumbnailSpec describes the thumbnails written next to uploaded images
+type ThumbnailSpec struct {
+	// Width and Height bound the thumbnail, which keeps the aspect ratio of the image.
+	// Zero leaves a dimension unbounded, and images are never enlarged
+	Width  int
+	Height int
+	// Suffix is added to the name of the image, before its extension, defaults to "_thumb"
+	Suffix string
+	// Format is "png", "jpeg" or "gif", defaults to the format of the image
+	Format string
+}
+
+// writeThumbnail writes a thumbnail of the image at path, following Tools.Thumbnail,
+// in the same directory and returns its file name
+func (t *Tools) writeThumbnail(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = t.checkDecodePixels(filepath.Base(path), f)
+	if err != nil {
+		return "", fmt.Errorf("thumbnail: %w", err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	img, format, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("thumbnail: %w", err)
+	}
+
+	spec := t.Thumbnail
+	if spec.Format != "" {
+		format = spec.Format
+	}
+
+	suffix := spec.Suffix
+	if suffix == "" {
+		suffix = "_thumb"
+	}
+
+	var ext string
+	var encode func(w io.Writer, img image.Image) error
+	switch format {
+	case "png":
+		ext, encode = ".png", png.Encode
+	case "jpeg":
+		ext = ".jpg"
+		encode = func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, nil)
+		}
+	case "gif":
+		ext = ".gif"
+		encode = func(w io.Writer, img image.Image) error {
+			return gif.Encode(w, img, nil)
+		}
+	default:
+		return "", fmt.Errorf("thumbnail: unsupported format %q", format)
+	}
+
+	base := filepath.Base(path)
+	name := strings.TrimSuffix(base, filepath.Ext(base)) + suffix + ext
+
+	width, height := fitWithin(img.Bounds().Dx(), img.Bounds().Dy(), spec.Width, spec.Height)
+	thumb := resizeImage(img, width, height)
+
+	_, err = t.writeFileAtomically(filepath.Join(filepath.Dir(path), name), func(out *os.File) (int64, error) {
+		return 0, encode(out, thumb)
+	})
+	if err != nil {
+		return "", fmt.Errorf("thumbnail: %w", err)
+	}
+
+	return name, nil
+}
+
+// fitWithin scales width and height down, keeping their ratio, so they fit within
+// maxWidth and maxHeight, where zero means unbounded
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+
+	w, h := int(math.Round(float64(width)*scale)), int(math.Round(float64(height)*scale))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h
+}
+
+// resizeImage scales src to width x height, averaging the source pixels covered by
+// every destination pixel, which gives smooth results when shrinking
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// UploadScanner checks the content of uploaded files, for instance with an antivirus
+type UploadScanner interface {
+	// Scan reads the file named name from r and returns an error to reject it
+	Scan(name string, r io.Reader) error
+}
+
+// ScanError is returned when UploadScanner rejects a file, and wraps the error it returned
+type ScanError struct {
+	FileName string
+	Err      error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("%s: rejected by the scanner: %s", e.FileName, e.Err)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// errScanAborted is what the scanner reads when the upload stops before the end of the file
+var errScanAborted = errors.New("the upload was aborted")
+
+// scanReader copies what is read through it to UploadScanner, running in its own goroutine,
+// and fails the read reaching the end of the file when the scanner rejects it
+type scanReader struct {
+	r        io.Reader
+	name     string
+	pw       *io.PipeWriter
+	result   chan error
+	finished bool
+}
+
+func (t *Tools) newScanReader(name string, r io.Reader) *scanReader {
+	pr, pw := io.Pipe()
+	s := &scanReader{r: r, name: name, pw: pw, result: make(chan error, 1)}
+
+	go func() {
+		err := t.UploadScanner.Scan(name, pr)
+		// a scanner which stops reading early mustn't block the upload
+		_, _ = io.Copy(io.Discard, pr)
+		s.result <- err
+	}()
+
+	return s
+}
+
+func (s *scanReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 && !s.finished {
+		// the pipe reader is drained until the end, so writes can't fail
+		_, _ = s.pw.Write(p[:n])
+	}
+
+	if err == io.EOF && !s.finished {
+		s.finished = true
+		_ = s.pw.Close()
+		if scanErr := <-s.result; scanErr != nil {
+			return n, &ScanError{FileName: s.name, Err: scanErr}
+		}
+	}
+
+	return n, err
+}
+
+// close stops the scanner when the file wasn't read to the end
+func (s *scanReader) close() {
+	if !s.finished {
+		s.finished = true
+		_ = s.pw.CloseWithError(errScanAborted)
+		<-s.result
+	}
+}
+
+// progressReader calls report with the number of bytes read so far after every read
+type progressReader struct {
+	r      io.Reader
+	copied int64
+	report func(copied int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.copied += int64(n)
+	p.report(p.copied)
+	return n, err
+}
+
+// reportProgress calls OnUploadProgress, recovering from a panic so it can't break the upload
+func (t *Tools) reportProgress(fileName string, copied, total int64) {
+	defer func() {
+		_ = recover()
+	}()
+
+	t.OnUploadProgress(fileName, copied, total)
+}
+
+// contextReader stops reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// ErrUploadTooSlow is returned when an upload is slower than Tools.MinUploadSpeed
+var ErrUploadTooSlow = errors.New("the upload is too slow")
+
+// minSpeedReader wraps an upload body and fails once fewer than minSpeed bytes per second
+// were received over the last window, a sliding window, so a client can't send a burst
+// then stall for most of each window. Reads of the body run in the background, so a client
+// which stops sending entirely fails too instead of blocking Read
+type minSpeedReader struct {
+	rc       io.ReadCloser
+	minSpeed int64
+	window   time.Duration
+	start    time.Time
+	// samples are the reads of the last window, and inWindow the bytes they hold
+	samples  []speedSample
+	inWindow int64
+	// pending receives the result of the read running in the background, if any
+	pending  chan speedRead
+	buf      []byte
+	leftover []byte
+	err      error
+}
+
+// speedSample is a read of minSpeedReader
+type speedSample struct {
+	at time.Time
+	n  int64
+}
+
+// speedRead is the result of a read of the body made by minSpeedReader
+type speedRead struct {
+	n   int
+	err error
+}
+
+func newMinSpeedReader(rc io.ReadCloser, minSpeed int64, window time.Duration) *minSpeedReader {
+	return &minSpeedReader{
+		rc:       rc,
+		minSpeed: minSpeed,
+		window:   window,
+		start:    time.Now(),
+	}
+}
+
+func (m *minSpeedReader) Read(p []byte) (int, error) {
+	if len(m.leftover) > 0 {
+		n := copy(p, m.leftover)
+		m.leftover = m.leftover[n:]
+		return n, nil
+	}
+	if m.err != nil {
+		return 0, m.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if m.pending == nil {
+		if cap(m.buf) < len(p) {
+			m.buf = make([]byte, len(p))
+		}
+		m.buf = m.buf[:len(p)]
+		m.pending = make(chan speedRead, 1)
+		go func(buf []byte, result chan<- speedRead) {
+			n, err := m.rc.Read(buf)
+			result <- speedRead{n: n, err: err}
+		}(m.buf, m.pending)
+	}
+
+	// data already received counts even when the deadline has passed
+	select {
+	case res := <-m.pending:
+		return m.received(p, res)
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(m.deadline()))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		// the read keeps running until the body is closed, its buffer isn't reused
+		m.pending, m.buf = nil, nil
+		m.err = ErrUploadTooSlow
+		return 0, m.err
+	case res := <-m.pending:
+		return m.received(p, res)
+	}
+}
+
+// received hands the result of the background read to Read
+func (m *minSpeedReader) received(p []byte, res speedRead) (int, error) {
+	m.pending = nil
+	m.add(int64(res.n))
+	n := copy(p, m.buf[:res.n])
+	m.leftover = m.buf[n:res.n]
+	m.err = res.err
+	if len(m.leftover) > 0 {
+		// the error comes once the leftover is read
+		return n, nil
+	}
+	return n, res.err
+}
+
+// add records n bytes received now and forgets the reads older than the window
+func (m *minSpeedReader) add(n int64) {
+	now := time.Now()
+	m.samples = append(m.samples, speedSample{at: now, n: n})
+	m.inWindow += n
+
+	expired := 0
+	for expired < len(m.samples) && now.Sub(m.samples[expired].at) >= m.window {
+		m.inWindow -= m.samples[expired].n
+		expired++
+	}
+	m.samples = m.samples[expired:]
+}
+
+// deadline is when the bytes received over the window will be too few unless more arrive.
+// No check happens during the first window
+func (m *minSpeedReader) deadline() time.Time {
+	required := int64(float64(m.minSpeed) * m.window.Seconds())
+
+	deadline := m.start.Add(m.window)
+	received := m.inWindow
+	// each sample leaves the window one window after it was received
+	for _, sample := range m.samples {
+		if received < required {
+			break
+		}
+		received -= sample.n
+		if expires := sample.at.Add(m.window); expires.After(deadline) {
+			deadline = expires
+		}
+	}
+	if received >= required {
+		// there isn't anything to expire, which can't happen with required above zero
+		return deadline.Add(m.window)
+	}
+
+	return deadline
+}
+
+func (m *minSpeedReader) Close() error {
+	return m.rc.Close()
+}
+
+// acquireUploadSlot blocks until a slot is free when MaxConcurrentUploads is set,
+// or ctx is cancelled. The returned func must be called to free the slot
+func (t *Tools) acquireUploadSlot(ctx context.Context) (func(), error) {
+	if t.MaxConcurrentUploads <= 0 {
+		return func() {}, nil
+	}
+
+	state := t.sharedState()
+	state.uploadSemMu.Lock()
+	if cap(state.uploadSem) != t.MaxConcurrentUploads {
+		// the files being written free their slot in the semaphore they took it from
+		state.uploadSem = make(chan struct{}, t.MaxConcurrentUploads)
+	}
+	sem := state.uploadSem
+	state.uploadSemMu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CreateDirIfNotExist is used to create a directory if the given path does not exists
+func (t *Tools) CreateDirIfNotExist(path string) error {
+	const mode = 0755
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := os.MkdirAll(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DirectorySize is used to get the total size in bytes of the regular files in path and
+// its subdirectories, e.g. to enforce a storage quota before accepting uploads.
+// Symbolic links are not followed, so nothing outside of path is counted
+func (t *Tools) DirectorySize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// ErrQuotaExceeded is returned when an uploaded file doesn't fit in Tools.MaxDirBytes
+var ErrQuotaExceeded = errors.New("the upload directory quota is exceeded")
+
+// dirSizeEntry is a directory size cached for DirSizeCacheTTL
+type dirSizeEntry struct {
+	size     int64
+	measured time.Time
+}
+
+// batchDirSize returns the size of dir before batch saved anything in it, measured once
+func (t *Tools) batchDirSize(batch *uploadBatch, dir string) (int64, error) {
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	size, ok := batch.dirSizes[dir]
+	if !ok {
+		var err error
+		size, err = t.cachedDirectorySize(dir)
+		if err != nil {
+			return 0, err
+		}
+		if batch.dirSizes == nil {
+			batch.dirSizes = make(map[string]int64)
+		}
+		batch.dirSizes[dir] = size
+	}
+
+	return size, nil
+}
+
+// cachedDirectorySize returns DirectorySize of dir, reusing a size measured less than
+// DirSizeCacheTTL ago. A directory which doesn't exist is empty
+func (t *Tools) cachedDirectorySize(dir string) (int64, error) {
+	if t.DirSizeCacheTTL <= 0 {
+		return t.directorySizeIfExists(dir)
+	}
+
+	state := t.sharedState()
+	state.dirSizesMu.Lock()
+	defer state.dirSizesMu.Unlock()
+
+	key := filepath.Clean(dir)
+	if entry, ok := state.dirSizes[key]; ok && time.Since(entry.measured) < t.DirSizeCacheTTL {
+		return entry.size, nil
+	}
+
+	size, err := t.directorySizeIfExists(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if state.dirSizes == nil {
+		state.dirSizes = make(map[string]dirSizeEntry)
+	}
+	state.dirSizes[key] = dirSizeEntry{size: size, measured: time.Now()}
+
+	return size, nil
+}
+
+func (t *Tools) directorySizeIfExists(dir string) (int64, error) {
+	size, err := t.DirectorySize(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	return size, err
+}
+
+// addDirSize adds the size of a file saved in dir to its cached size, if any
+func (t *Tools) addDirSize(dir string, n int64) {
+	state := t.sharedState()
+	state.dirSizesMu.Lock()
+	defer state.dirSizesMu.Unlock()
+
+	key := filepath.Clean(dir)
+	if entry, ok := state.dirSizes[key]; ok {
+		entry.size += n
+		state.dirSizes[key] = entry
+	}
+}
+
+// ErrSlugIsEmpty is returned by Slugify when nothing is left after removing characters and stop words
+var ErrSlugIsEmpty = errors.New("after removing characters, slug is zero length")
+
+// Slugify is used to convert string to URL safe string (slug).
+// Words in SlugStopWords are removed first
+func (t *Tools) Slugify(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty string not permitted")
+	}
+
+	if len(t.SlugStopWords) > 0 {
+		words := make([]string, len(t.SlugStopWords))
+		for i, w := range t.SlugStopWords {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		stopWords := regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+		s = stopWords.ReplaceAllString(s, " ")
+	}
+
+	re := regexp.MustCompile(`[^a-z\d]+`)
+
+	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
+
+	if len(slug) == 0 {
+		return "", ErrSlugIsEmpty
+	}
+
+	return slug, nil
+}
+
+// IsSlug reports whether s is already a valid slug, i.e. Slugify would return it unchanged.
+// It is useful to validate slugs supplied by clients instead of re-slugifying them
+func (t *Tools) IsSlug(s string) bool {
+	slug, err := t.Slugify(s)
+
+	return err == nil && slug == s
+}
+
+// DownloadStaticFile downloads a file, and tries to force browsers to avoid
+// displaying it in the browser window by setting content disposition.
+// It also allows specification of the display name
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
+	w.Header().Set("Content-Disposition", contentDisposition(displayName))
+
+	http.ServeFile(w, r, pathName)
+}
+
+// DownloadStaticFilePrecompressed works like DownloadStaticFile, but when the client
+// accepts gzip and a pathName.gz file exists next to pathName, the compressed file is
+// sent instead with Content-Encoding: gzip and the content type of the original file
+func (t *Tools) DownloadStaticFilePrecompressed(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
+	w.Header().Set("Content-Disposition", contentDisposition(displayName))
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if acceptsGzip(r) {
+		if info, err := os.Stat(pathName + ".gz"); err == nil && info.Mode().IsRegular() {
+			contentType := mime.TypeByExtension(filepath.Ext(pathName))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Encoding", "gzip")
+
+			http.ServeFile(w, r, pathName+".gz")
+			return
+		}
+	}
+
+	http.ServeFile(w, r, pathName)
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+
+		q := strings.TrimSpace(params)
+		if !strings.HasPrefix(q, "q=") {
+			return true
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64)
+		return err == nil && weight > 0
+	}
+
+	return false
+}
+
+// DownloadZip is used to send several files as a single zip archive named displayName.
+// files maps the name of each entry in the archive to the path of the file on disk. The
+// archive is streamed to the client as it is built, so once the first entry is written
+// an error can only be returned, not reported to the client
+func (t *Tools) DownloadZip(w http.ResponseWriter, displayName string, files map[string]string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(displayName))
+
+	zw := zip.NewWriter(w)
+
+	for _, name := range names {
+		err := addFileToZip(zw, name, files[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// addFileToZip copies the file at pathName into zw as an entry called name
+func addFileToZip(zw *zip.Writer, name, pathName string) error {
+	f, err := os.Open(pathName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, f)
+
+	return err
+}
+
+// contentDisposition builds an attachment Content-Disposition header for name. Names with
+// non-ASCII characters get an RFC 5987 encoded filename* parameter alongside an ASCII fallback
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	ascii := true
+	for _, c := range name {
+		switch {
+		case c > unicode.MaxASCII || c < 0x20 || c == 0x7f:
+			ascii = false
+			fallback.WriteByte('_')
+		case c == '"' || c == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(c)
+		default:
+			fallback.WriteRune(c)
+		}
+	}
+
+	header := fmt.Sprintf("attachment; filename=\"%s\"", fallback.String())
+	if ascii {
+		return header
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return header + "; filename*=UTF-8''" + encoded.String()
+}
+
+// isAttrChar reports whether b can appear unencoded in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// TimeFormatUnix is a special TimeFormat which emits timestamps as seconds since Unix epoch
+const TimeFormatUnix = "unix"
+
+// FormattedTime wraps time.Time so it is marshalled to JSON using Layout instead of RFC 3339
+// with nanoseconds. Use Tools.FormatTime to build one with the configured TimeFormat
+type FormattedTime struct {
+	time.Time
+	Layout string
+}
+
+// MarshalJSON implements json.Marshaler
+func (ft FormattedTime) MarshalJSON() ([]byte, error) {
+	switch ft.Layout {
+	case "":
+		return ft.Time.MarshalJSON()
+	case TimeFormatUnix:
+		return []byte(fmt.Sprintf("%d", ft.Unix())), nil
+	default:
+		return json.Marshal(ft.Format(ft.Layout))
+	}
+}
+
+// FormatTime is used to wrap tm so it is written by WriteJSON using Tools.TimeFormat
+func (t *Tools) FormatTime(tm time.Time) FormattedTime {
+	return FormattedTime{Time: tm, Layout: t.TimeFormat}
+}
+
+// JSONResponse is the type used for sending JSON around
+type JSONResponse struct {
+	Error      bool        `json:"error"`
+	Message    string      `json:"message"`
+	Data       interface{} `json:"data,omitempty"`
+	APIVersion string      `json:"api_version,omitempty"`
+}
+
+// MaxBytesMiddleware is used to limit the size of every request body to RequestSizeLimit,
+// the same limit ReadJSON applies, so both don't have to be configured separately
+func (t *Tools) MaxBytesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.RequestSizeLimit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, t.RequestSizeLimit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxJSONSizeKey is the context key used by WithMaxJSONSize
+type maxJSONSizeKey struct{}
+
+// WithMaxJSONSize returns a copy of ctx which makes ReadJSON accept bodies up to size bytes,
+// overriding Tools.MaxJSONSize for requests using it, e.g. r.WithContext(WithMaxJSONSize(r.Context(), size))
+func WithMaxJSONSize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, maxJSONSizeKey{}, size)
+}
+
+// jsonSizeLimit returns the body size limit for r, from WithMaxJSONSize, RequestSizeLimit
+// or MaxJSONSize in that order
+func (t *Tools) jsonSizeLimit(r *http.Request) int64 {
+	if size, ok := r.Context().Value(maxJSONSizeKey{}).(int64); ok {
+		return size
+	}
+
+	if t.RequestSizeLimit != 0 {
+		return t.RequestSizeLimit
+	}
+
+	if t.MaxJSONSize != 0 {
+		return t.MaxJSONSize
+	}
+
+	return defaultMaxJSONSize
+}
+
+// ReadJSON is used to read request and then send it back
+func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) (err error) {
+	maxSize := t.jsonSizeLimit(r)
+
+	body := &countingReader{r: http.MaxBytesReader(w, r.Body, maxSize)}
+	r.Body = body
+	defer func(start time.Time) {
+		t.record(MetricReadJSON, start, body.n, err)
+	}(time.Now())
+
+	dec := json.NewDecoder(r.Body)
+
+	if !t.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	err = dec.Decode(data)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var invalidUnmarshalError *json.InvalidUnmarshalError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+		case errors.As(err, &unmarshalTypeError):
+			return fmt.Errorf("body contains badly-formed JSON")
+		case errors.As(err, &invalidUnmarshalError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case strings.HasPrefix(err.Error(), "json: unknown field"):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+		case err.Error() == "http: request body too large":
+			return fmt.Errorf("body must not be larger than %d bytes", maxSize)
+		case errors.As(err, &invalidUnmarshalError):
+			return fmt.Errorf("error unmarshalling JSON: %s", err)
+		default:
+			return err
+		}
+	}
+
+	if t.AllowTrailingData {
+		return nil
+	}
+
+	err = dec.Decode(&struct{}{})
+	if err != io.EOF {
+		return errors.New("body must contain only one JSON value")
+	}
+
+	return nil
+}
+
+// StreamJSONArray is used to process a request body holding a JSON array one element at a
+// time, without loading the whole array into memory. fn is called for every element and
+// processing stops at the first error it returns. The body is limited like in ReadJSON, and
+// each element, with the separator before it, must not be larger than MaxJSONSize
+func (t *Tools) StreamJSONArray(r *http.Request, fn func(raw json.RawMessage) error) error {
+	maxSize := int64(defaultMaxJSONSize)
+	if t.MaxJSONSize != 0 {
+		maxSize = t.MaxJSONSize
+	}
+	maxBodySize := t.jsonSizeLimit(r)
+
+	r.Body = http.MaxBytesReader(nil, r.Body, maxBodySize)
+	body := &elementReader{r: r.Body, limit: maxSize}
+	dec := json.NewDecoder(body)
+
+	token, err := dec.Token()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("body must not be empty")
+		}
+		return streamJSONError(err, maxBodySize)
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return errors.New("body must be a JSON array")
+	}
+
+	for i := 0; dec.More(); i++ {
+		// an element is never read further than maxSize bytes past the previous one
+		body.limit = dec.InputOffset() + maxSize
+
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if errors.Is(err, errElementTooLarge) || err == nil && int64(len(raw)) > maxSize {
+			return fmt.Errorf("element %d must not be larger than %d bytes", i, maxSize)
+		}
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				return streamJSONError(err, maxBodySize)
+			}
+			return fmt.Errorf("element %d contains badly-formed JSON: %w", i, err)
+		}
+
+		err = fn(raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	// consume the closing bracket
+	body.limit = dec.InputOffset() + maxSize
+	_, err = dec.Token()
+	if err != nil {
+		return streamJSONError(err, maxBodySize)
+	}
+
+	return nil
+}
+
+// errElementTooLarge is returned by elementReader once its limit is reached
+var errElementTooLarge = errors.New("the JSON element is too large")
+
+// elementReader stops reading from r at the offset limit, which StreamJSONArray moves
+// forward before decoding every element
+type elementReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (e *elementReader) Read(p []byte) (int, error) {
+	if e.read >= e.limit {
+		return 0, errElementTooLarge
+	}
+
+	if int64(len(p)) > e.limit-e.read {
+		p = p[:e.limit-e.read]
+	}
+	n, err := e.r.Read(p)
+	e.read += int64(n)
+	return n, err
+}
+
+// streamJSONError describes the errors of StreamJSONArray outside of the elements
+func streamJSONError(err error, maxBodySize int64) error {
+	switch {
+	case err.Error() == "http: request body too large":
+		return fmt.Errorf("body must not be larger than %d bytes", maxBodySize)
+	case errors.Is(err, errElementTooLarge):
+		return errors.New("body contains too much data outside of the array elements")
+	default:
+		return err
+	}
+}
+
+// ReadNDJSON is used to read a newline delimited JSON body one line at a time, calling
+// handle for every JSON value. Blank lines are skipped, and reading stops at the first
+// malformed line or error returned by handle. The body is limited like in ReadJSON
+func (t *Tools) ReadNDJSON(w http.ResponseWriter, r *http.Request, handle func(raw json.RawMessage) error) error {
+	maxSize := t.jsonSizeLimit(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(maxSize))
+
+	for line := 1; scanner.Scan(); line++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		if !json.Valid(raw) {
+			return fmt.Errorf("body contains badly-formed JSON on line %d", line)
+		}
+
+		// the scanner reuses its buffer, so hand out a copy
+		err := handle(append(json.RawMessage(nil), raw...))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		if err.Error() == "http: request body too large" || errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("body must not be larger than %d bytes", maxSize)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// WriteJSON takes response, request, status, data, will respond to client in JSON.
+// DefaultResponseHeaders are always sent, headers passed in override them. When
+// WebhookSecret is set the body is signed in the X-Webhook-Signature header
+func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) (err error) {
+	var body bytes.Buffer
+	defer func(start time.Time) {
+		t.record(MetricWriteJSON, start, int64(body.Len()), err)
+	}(time.Now())
+
+	for key, value := range t.DefaultResponseHeaders {
+		w.Header()[key] = value
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	if t.APIVersion != "" {
+		switch resp := data.(type) {
+		case JSONResponse:
+			resp.APIVersion = t.APIVersion
+			data = resp
+		case *JSONResponse:
+			if resp != nil {
+				versioned := *resp
+				versioned.APIVersion = t.APIVersion
+				data = versioned
+			}
+		}
+	}
+
+	enc := json.NewEncoder(&body)
+	if t.JSONIndent != "" {
+		enc.SetIndent("", t.JSONIndent)
+	} else if t.DevMode {
+		enc.SetIndent("", "  ")
+	}
+	err = enc.Encode(data)
+	if err != nil {
+		return err
+	}
+
+	if t.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(t.WebhookSecret))
+		mac.Write(body.Bytes())
+		w.Header().Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	w.Header().Set("Application-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(body.Bytes())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// MergeJSON is used to combine several values, which must marshal to JSON objects, into a
+// single object which can be sent with WriteJSON. Later keys override earlier ones, and when
+// DeepMergeJSON is set nested objects are merged key by key instead of being replaced
+func (t *Tools) MergeJSON(objects ...interface{}) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+
+	for i, obj := range objects {
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		var m map[string]interface{}
+		err = json.Unmarshal(b, &m)
+		if err != nil {
+			return nil, fmt.Errorf("object %d is not a JSON object", i)
+		}
+
+		mergeJSONMaps(merged, m, t.DeepMergeJSON)
+	}
+
+	return merged, nil
+}
+
+// mergeJSONMaps copies src into dst, recursing into nested objects when deep is set
+func mergeJSONMaps(dst, src map[string]interface{}, deep bool) {
+	for key, value := range src {
+		if deep {
+			srcMap, srcIsMap := value.(map[string]interface{})
+			dstMap, dstIsMap := dst[key].(map[string]interface{})
+			if srcIsMap && dstIsMap {
+				mergeJSONMaps(dstMap, srcMap, deep)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// ErrorJSON is used to format an error into JSON response. When err wraps several
+// errors, e.g. from errors.Join, their messages are sent as an array in data
+func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	errResponse := JSONResponse{
+		Error:   true,
+		Message: err.Error(),
+	}
+
+	// errors joined with errors.Join are sent as a list instead of one multi-line message
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var messages []string
+		for _, e := range joined.Unwrap() {
+			messages = append(messages, e.Error())
+		}
+		errResponse.Message = fmt.Sprintf("%d errors occurred", len(messages))
+		errResponse.Data = messages
+	}
+
+	return t.WriteJSON(w, statusCode, errResponse)
+}
+
+// ErrorJSONRateLimited is used to send a 429 Too Many Requests JSON error, telling the
+// client through Retry-After how many seconds to wait before trying again
+func (t *Tools) ErrorJSONRateLimited(w http.ResponseWriter, retryAfter time.Duration) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+
+	return t.ErrorJSON(w, errors.New("too many requests, please try again later"), http.StatusTooManyRequests)
+}
+
+// Result is the outcome of a handler, built with Ok or Fail and sent with Tools.Write
+type Result struct {
+	Status  int
+	Message string
+	Data    interface{}
+	Err     error
+}
+
+// Ok is used to build a successful Result holding data
+func Ok(data interface{}) Result {
+	return Result{Status: http.StatusOK, Data: data}
+}
+
+// Fail is used to build a failed Result with the given status
+func Fail(err error, status int) Result {
+	return Result{Status: status, Err: err}
+}
+
+// xmlResponse is the XML counterpart of JSONResponse
+type xmlResponse struct {
+	XMLName xml.Name    `xml:"response"`
+	Error   bool        `xml:"error"`
+	Message string      `xml:"message"`
+	Data    interface{} `xml:"data,omitempty"`
+}
+
+// Write is used to send result to the client as a JSONResponse, or as XML when the
+// Accept header of r prefers it, with the status of the result
+func (t *Tools) Write(w http.ResponseWriter, r *http.Request, result Result) error {
+	status := result.Status
+	if status == 0 {
+		status = http.StatusOK
+		if result.Err != nil {
+			status = http.StatusBadRequest
+		}
+	}
+
+	response := JSONResponse{
+		Message: result.Message,
+		Data:    result.Data,
+	}
+	if result.Err != nil {
+		response.Error = true
+		response.Message = result.Err.Error()
+	}
+
+	if !prefersXML(r) {
+		return t.WriteJSON(w, status, response)
+	}
+
+	out, err := xml.Marshal(xmlResponse{Error: response.Error, Message: response.Message, Data: response.Data})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, err = w.Write(append([]byte(xml.Header), out...))
+
+	return err
+}
+
+// prefersXML reports whether the Accept header of r lists an XML type before any JSON type
+func prefersXML(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(mediaType, "/json"):
+			return false
+		case strings.HasSuffix(mediaType, "/xml"):
+			return true
+		}
+	}
+
+	return false
+}
+
+// PushJSONToRemote is used to push JSON to specified uri
+// Http client is optional, if not specified we use default Http Client.
+// Failing requests are returned as a RemoteError. The status of the response is left to
+// the caller unless PushRequireSuccess is set
+func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (_ *http.Response, err error) {
+	var payload []byte
+	defer func(start time.Time) {
+		t.record(MetricPushJSON, start, int64(len(payload)), err)
+	}(time.Now())
+
+	marshal := json.Marshal
+	if t.MarshalFunc != nil {
+		marshal = t.MarshalFunc
+	}
+
+	payload, err = marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var httpClient http.Client
+	if len(client) > 0 {
+		httpClient = *client[0]
+	} else {
+		httpClient = http.Client{}
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, newRemoteError(uri, err)
+	}
+	// defer res.Body.Close()
+
+	if t.PushRequireSuccess && (res.StatusCode < 200 || res.StatusCode > 299) {
+		_ = res.Body.Close()
+		return nil, &RemoteError{
+			Kind:       RemoteErrorStatus,
+			URL:        uri,
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("remote service responded with status %d", res.StatusCode),
+		}
+	}
+
+	return res, nil
+}
+
+// RemoteErrorKind categorizes a RemoteError so callers can decide whether to retry
+type RemoteErrorKind int
+
+const (
+	// RemoteErrorOther is any failure which doesn't fit another kind
+	RemoteErrorOther RemoteErrorKind = iota
+	// RemoteErrorDNS means the host name could not be resolved
+	RemoteErrorDNS
+	// RemoteErrorTimeout means the request timed out
+	RemoteErrorTimeout
+	// RemoteErrorStatus means the remote service responded with a non 2xx status
+	RemoteErrorStatus
+	// RemoteErrorDecode means the response body could not be decoded
+	RemoteErrorDecode
+)
+
+// RemoteError is returned by PushJSONToRemote and FetchJSON when talking to the remote
+// service fails. StatusCode is only set when a response was received, PushJSONToRemote
+// only reports error statuses with PushRequireSuccess
+type RemoteError struct {
+	Kind       RemoteErrorKind
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("request to %s failed: %s", e.URL, e.Err)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the request timed out
+func (e *RemoteError) Timeout() bool {
+	return e.Kind == RemoteErrorTimeout
+}
+
+// newRemoteError wraps an error returned while sending a request to uri
+func newRemoteError(uri string, err error) *RemoteError {
+	kind := RemoteErrorOther
+
+	var dnsError *net.DNSError
+	var netError net.Error
+	switch {
+	case errors.As(err, &dnsError):
+		kind = RemoteErrorDNS
+	case errors.As(err, &netError) && netError.Timeout():
+		kind = RemoteErrorTimeout
+	}
+
+	return &RemoteError{Kind: kind, URL: uri, Err: err}
+}
+
+// FetchOptions is used to configure FetchJSON
+type FetchOptions struct {
+	// AllowPrivateNetworks disables the check against private, loopback and link-local addresses
+	AllowPrivateNetworks bool
+	// Client is an optional Http client, if not specified we use a client which re-checks
+	// every address it dials so redirects and DNS rebinding can't reach internal hosts
+	Client *http.Client
+}
+
+// FetchJSON is used to GET JSON from specified uri and decode it into target.
+// The host of uri is resolved first and any private, loopback or link-local address
+// is rejected unless opts.AllowPrivateNetworks is set, so it is safe to use with
+// user supplied URLs. The default client then connects directly, ignoring the proxy
+// environment variables, so every address it dials can be checked
+func (t *Tools) FetchJSON(uri string, target interface{}, opts FetchOptions) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	if !opts.AllowPrivateNetworks {
+		ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), u.Hostname())
+		if err != nil {
+			return newRemoteError(uri, err)
+		}
+
+		for _, ip := range ips {
+			if isPrivateIP(ip.IP) {
+				return fmt.Errorf("host %q resolves to a non-public address", u.Hostname())
+			}
+		}
+	}
+
+	httpClient := opts.Client
+	if httpClient == nil {
+		httpClient = &http.Client{}
+		if !opts.AllowPrivateNetworks {
+			dialer := &net.Dialer{
+				Control: func(network, address string, c syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+						return fmt.Errorf("address %q is not a public address", host)
+					}
+					return nil
+				},
+			}
+			// no proxy, the dialer would only check the address of the proxy
+			httpClient.Transport = &http.Transport{
+				DialContext: dialer.DialContext,
+			}
+		}
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return newRemoteError(uri, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &RemoteError{
+			Kind:       RemoteErrorStatus,
+			URL:        uri,
+			StatusCode: res.StatusCode,
+			Err:        fmt.Errorf("remote service responded with status %d", res.StatusCode),
+		}
+	}
+
+	maxSize := int64(defaultMaxJSONSize)
+	if t.MaxJSONSize != 0 {
+		maxSize = t.MaxJSONSize
+	}
+
+	err = json.NewDecoder(io.LimitReader(res.Body, maxSize)).Decode(target)
+	if err != nil {
+		return &RemoteError{Kind: RemoteErrorDecode, URL: uri, StatusCode: res.StatusCode, Err: err}
+	}
+
+	return nil
+}
+
+// nonPublicNetworks are the ranges isPrivateIP rejects besides those the net.IP methods know
+var nonPublicNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"100.64.0.0/10",  // carrier-grade NAT
+		"192.0.0.0/24",   // IETF protocol assignments
+		"198.18.0.0/15",  // benchmarking
+		"240.0.0.0/4",    // reserved, and the broadcast address
+		"64:ff9b:1::/48", // local-use NAT64
+		"2001:db8::/32",  // documentation
+		"100::/64",       // discard-only
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// nat64Prefix is the well-known NAT64 prefix, whose addresses embed an IPv4 address in
+// their last 4 bytes
+var nat64Prefix = net.IP{0x00, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// isPrivateIP reports whether ip belongs to a range that should not be reachable
+// from user supplied URLs. IPv4-mapped and NAT64 addresses are checked by the IPv4
+// address they embed
+func isPrivateIP(ip net.IP) bool {
+	if ip16 := ip.To16(); ip16 != nil && ip.To4() == nil && bytes.Equal(ip16[:12], nat64Prefix) {
+		ip = net.IP(ip16[12:])
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified()
+}
+
+// ServeAndShutdown is used to run srv until a signal is received on stopCh, then
+// gracefully shut it down, waiting up to ShutdownTimeout for in-flight requests
+func (t *Tools) ServeAndShutdown(srv *http.Server, stopCh <-chan os.Signal) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// the server stopped on its own before any signal, e.g. the address is in use
+		return err
+	case <-stopCh:
+	}
+
+	timeout := defaultShutdownTimeout
+	if t.ShutdownTimeout != 0 {
+		timeout = t.ShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// CachedResponse is a captured HTTP response which can be sent again with ReplayResponse
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	CachedAt   time.Time
+}
+
+// ReplayResponse is used to write a previously captured response to w. It marks the
+// response with X-Cache: HIT and sets Age to the whole number of seconds since it was cached
+func (t *Tools) ReplayResponse(w http.ResponseWriter, cached *CachedResponse) error {
+	if cached == nil {
+		return errors.New("no cached response to replay")
+	}
+
+	for key, value := range cached.Header {
+		w.Header()[key] = append([]string(nil), value...)
+	}
+
+	age := time.Since(cached.CachedAt)
+	if age < 0 {
+		age = 0
+	}
+
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+
+	statusCode := cached.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	w.WriteHeader(statusCode)
+	_, err := w.Write(cached.Body)
+
+	return err
+}
+
+// SizeOf is used to estimate how much space v takes, as the length of its JSON encoding.
+// It is a cheap approximation for cache budgeting, -1 is returned if v can't be encoded
+func (t *Tools) SizeOf(v interface{}) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return -1
+	}
+
+	return len(b)
+}
+
+// UnsafeSizeOf is used to estimate the in-memory size of v in bytes. It adds the size of
+// the value itself, as unsafe.Sizeof would report it, to the size of everything reachable
+// through its pointers, slices, maps, strings and interfaces. Memory shared between
+// several references is only counted once
+func (t *Tools) UnsafeSizeOf(v interface{}) uintptr {
+	if v == nil {
+		return 0
+	}
+
+	rv := reflect.ValueOf(v)
+
+	return rv.Type().Size() + deepSizeOf(rv, make(map[uintptr]bool))
+}
+
+// deepSizeOf returns the size of the memory referenced by v, not including v itself
+func deepSizeOf(v reflect.Value, seen map[uintptr]bool) uintptr {
+	var size uintptr
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		size = v.Elem().Type().Size() + deepSizeOf(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		size = v.Elem().Type().Size() + deepSizeOf(v.Elem(), seen)
+	case reflect.String:
+		size = uintptr(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		size = uintptr(v.Cap()) * v.Type().Elem().Size()
+		for i := 0; i < v.Len(); i++ {
+			size += deepSizeOf(v.Index(i), seen)
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			size += deepSizeOf(v.Index(i), seen)
+		}
+	case reflect.Map:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		iter := v.MapRange()
+		for iter.Next() {
+			size += iter.Key().Type().Size() + deepSizeOf(iter.Key(), seen)
+			size += iter.Value().Type().Size() + deepSizeOf(iter.Value(), seen)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			size += deepSizeOf(v.Field(i), seen)
+		}
+	}
+
+	return size
+}
+
+var (
+	// ErrInvalidToken is returned by ParseJWT for malformed tokens and bad signatures
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned by ParseJWT when the exp claim is in the past
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrTokenNotYetValid is returned by ParseJWT when the nbf claim is in the future
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+)
+
+// ParseJWT is used to verify a HS256 signed JSON Web Token with secret and return its claims.
+// The exp and nbf claims are checked when present. Any other algorithm, including "none", is rejected
+func (t *Tools) ParseJWT(token string, secret []byte) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := float64(time.Now().Unix())
+
+	if exp, ok := claims["exp"]; ok {
+		expiry, ok := exp.(float64)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		if now >= expiry {
+			return nil, ErrTokenExpired
+		}
+	}
+
+	if nbf, ok := claims["nbf"]; ok {
+		notBefore, ok := nbf.(float64)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		if now < notBefore {
+			return nil, ErrTokenNotYetValid
+		}
+	}
+
+	return claims, nil
+}
+
+const totpStep = 30 // seconds
+const totpDigits = 6
+
+// GenerateTOTPSecret is used to generate a random base32 encoded secret for TOTPCode
+func (t *Tools) GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := io.ReadFull(t.randSource(), secret)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// TOTPCode is used to compute the RFC 6238 time-based one-time password for the base32
+// encoded secret at tm, using HMAC-SHA1, a 30 second step and 6 digits
+func (t *Tools) TOTPCode(secret string, tm time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(strings.ToUpper(strings.TrimSpace(secret)), "="))
+	if err != nil {
+		return "", errors.New("the secret is not valid base32")
+	}
+
+	return hotp(key, uint64(tm.Unix()/totpStep)), nil
+}
+
+// ValidateTOTP reports whether code is valid for secret at tm, also accepting codes from
+// up to skew steps before or after tm to tolerate clock drift
+func (t *Tools) ValidateTOTP(secret, code string, tm time.Time, skew int) bool {
+	for i := -skew; i <= skew; i++ {
+		expected, err := t.TOTPCode(secret, tm.Add(time.Duration(i*totpStep)*time.Second))
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hotp computes the RFC 4226 one-time password of key for counter
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// ValidateCSVUpload is used to check the structure of an uploaded CSV file: its header row must
+// contain every one of requiredColumns, compared case-insensitively, and it must not have more
+// than maxRows data rows. A maxRows of zero means there is no limit
+func (t *Tools) ValidateCSVUpload(path string, requiredColumns []string, maxRows int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("the CSV file is empty")
+		}
+		return fmt.Errorf("the CSV file is malformed: %w", err)
+	}
+
+	columns := make(map[string]bool, len(header))
+	for i, column := range header {
+		if i == 0 {
+			column = strings.TrimPrefix(column, "\ufeff")
+		}
+		columns[strings.ToLower(strings.TrimSpace(column))] = true
+	}
+
+	var missing []string
+	for _, required := range requiredColumns {
+		if !columns[strings.ToLower(strings.TrimSpace(required))] {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the CSV file is missing required columns: %s", strings.Join(missing, ", "))
+	}
+
+	for rows := 1; ; rows++ {
+		_, err = reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("the CSV file is malformed: %w", err)
+		}
+		if maxRows > 0 && rows > maxRows {
+			return fmt.Errorf("the CSV file must not have more than %d rows", maxRows)
+		}
+	}
+}
+
+// NegotiateLanguage is used to pick the locale from supported which best matches the
+// Accept-Language header of r, honouring quality values. A language only matching the
+// primary subtag, e.g. "en-GB" for a supported "en", is still accepted. When nothing
+// matches, the first supported locale is returned
+func (t *Tools) NegotiateLanguage(r *http.Request, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+
+	var languages []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+
+		q := 1.0
+		if value := strings.TrimSpace(params); strings.HasPrefix(value, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(value, "q="), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if q > 0 {
+			languages = append(languages, weighted{tag: strings.TrimSpace(tag), q: q})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+
+	for _, lang := range languages {
+		if lang.tag == "*" {
+			return supported[0]
+		}
+
+		for _, s := range supported {
+			if strings.EqualFold(s, lang.tag) {
+				return s
+			}
+		}
+
+		primary, _, _ := strings.Cut(lang.tag, "-")
+		for _, s := range supported {
+			supportedPrimary, _, _ := strings.Cut(s, "-")
+			if strings.EqualFold(supportedPrimary, primary) {
+				return s
+			}
+		}
+	}
+
+	return supported[0]
+}
+
+// ErrUnsafeRedirect is returned by SafeRedirectURL for URLs leading to other sites
+var ErrUnsafeRedirect = errors.New("redirect URL is not permitted")
+
+// SafeRedirectURL is used to validate a redirect target supplied by the client, e.g. a
+// ?next= parameter, to prevent open redirects. Only relative paths, and http(s) URLs whose
+// host is in allowedHosts, are permitted. Protocol-relative URLs like //evil.com are rejected
+func (t *Tools) SafeRedirectURL(candidate string, allowedHosts []string) (string, error) {
+	candidate = strings.TrimSpace(candidate)
+	if candidate == "" {
+		return "", ErrUnsafeRedirect
+	}
+
+	// browsers treat a backslash like a slash, and ignore some control characters
+	for _, c := range candidate {
+		if c == '\\' || unicode.IsControl(c) {
+			return "", ErrUnsafeRedirect
+		}
+	}
+
+	u, err := url.Parse(candidate)
+	if err != nil {
+		return "", ErrUnsafeRedirect
+	}
+
+	if u.Scheme == "" && u.Host == "" && !u.ForceQuery && u.User == nil {
+		if strings.HasPrefix(candidate, "//") {
+			return "", ErrUnsafeRedirect
+		}
+		return candidate, nil
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ErrUnsafeRedirect
+	}
+
+	for _, host := range allowedHosts {
+		if strings.EqualFold(u.Host, host) || strings.EqualFold(u.Hostname(), host) {
+			return u.String(), nil
+		}
+	}
+
+	return "", ErrUnsafeRedirect
+}
+
+// ErrMissingIdempotencyKey is returned by CheckIdempotency when a mutating request has no Idempotency-Key header
+var ErrMissingIdempotencyKey = errors.New("the Idempotency-Key header is required")
+
+// IdempotencyStore keeps the responses sent for idempotency keys
+type IdempotencyStore interface {
+	// Get returns the response recorded for key, or nil if there is none
+	Get(key string) (*JSONResponse, error)
+	// Save records the response sent for key
+	Save(key string, response *JSONResponse) error
+}
+
+// CheckIdempotency is used to enforce idempotency keys on mutating requests. It reads the
+// Idempotency-Key header of r and returns the response already recorded in store for it, if
+// any, so the handler can send it again instead of repeating the operation. Otherwise the
+// handler should save its response in store under the returned key. Safe methods, like GET,
+// are not checked and return an empty key
+func (t *Tools) CheckIdempotency(r *http.Request, store IdempotencyStore) (cached *JSONResponse, key string, err error) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil, "", nil
+	}
+
+	key = strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if key == "" {
+		return nil, "", ErrMissingIdempotencyKey
+	}
+
+	cached, err = store.Get(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cached, key, nil
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore keeping responses in memory, suitable
+// for a single instance. It is safe for concurrent use
+type MemoryIdempotencyStore struct {
+	mu        sync.RWMutex
+	responses map[string]*JSONResponse
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{responses: make(map[string]*JSONResponse)}
+}
+
+// Get returns the response recorded for key, or nil if there is none
+func (s *MemoryIdempotencyStore) Get(key string) (*JSONResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.responses[key], nil
+}
+
+// Save records the response sent for key
+func (s *MemoryIdempotencyStore) Save(key string, response *JSONResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses[key] = response
+
+	return nil
+}
+
+// Operation names reported to Metrics
+const (
+	MetricUpload    = "upload"
+	MetricReadJSON  = "read_json"
+	MetricWriteJSON = "write_json"
+	MetricPushJSON  = "push_json"
+)
+
+// Metrics is implemented by users to export counters and histograms, for instance to
+// Prometheus, of the operations done by Tools. op is one of the Metric constants
+type Metrics interface {
+	// ObserveBytes records the number of bytes processed by one operation
+	ObserveBytes(op string, n int64)
+	// ObserveDuration records how long one operation took
+	ObserveDuration(op string, d time.Duration)
+	// IncErrors counts an operation which failed
+	IncErrors(op string)
+}
+
+// record reports one operation started at start to Metrics, if set
+func (t *Tools) record(op string, start time.Time, n int64, err error) {
+	if t.Metrics == nil {
+		return
+	}
+
+	t.Metrics.ObserveDuration(op, time.Since(start))
+	t.Metrics.ObserveBytes(op, n)
+	if err != nil {
+		t.Metrics.IncErrors(op)
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
 }
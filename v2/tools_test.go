@@ -1,8 +1,18 @@
 package toolkit
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"image"
@@ -10,11 +20,20 @@ import (
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestTools_RandomString(t *testing.T) {
@@ -195,6 +214,18 @@ func TestTools_UploadOneFile(t *testing.T) {
 		t.Errorf("expected file to have name changed, got %q", file.NewFileName)
 	}
 
+	if file.ContentType != "image/png" {
+		t.Errorf("expected content type image/png, got %q", file.ContentType)
+	}
+
+	if file.FullPath != filepath.Join("./testdata/uploads/", file.NewFileName) {
+		t.Errorf("expected the full path to be in the upload directory, got %q", file.FullPath)
+	}
+
+	if file.ImageWidth != 640 || file.ImageHeight != 426 {
+		t.Errorf("expected a 640x426 image, got %dx%d", file.ImageWidth, file.ImageHeight)
+	}
+
 	// clean up
 	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", file.NewFileName))
 
@@ -508,3 +539,4771 @@ func TestTools_PushJSONToRemote(t *testing.T) {
 		t.Error("There should be no error: ", err)
 	}
 }
+
+func TestTools_FetchJSON(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"foo":"bar"}`)),
+			Header:     http.Header{},
+		}
+	})
+
+	testcases := []struct {
+		name          string
+		uri           string
+		errorExpected bool
+	}{
+		{
+			name:          "cloud metadata address",
+			uri:           "http://169.254.169.254/",
+			errorExpected: true,
+		},
+		{
+			name:          "localhost",
+			uri:           "http://localhost/",
+			errorExpected: true,
+		},
+		{
+			name:          "private network",
+			uri:           "http://10.0.0.1/",
+			errorExpected: true,
+		},
+		{
+			name:          "unsupported scheme",
+			uri:           "file:///etc/passwd",
+			errorExpected: true,
+		},
+		{
+			name:          "public server",
+			uri:           "http://93.184.216.34/",
+			errorExpected: false,
+		},
+	}
+
+	var testTools Tools
+
+	for _, tc := range testcases {
+		var target struct {
+			Foo string `json:"foo"`
+		}
+
+		err := testTools.FetchJSON(tc.uri, &target, FetchOptions{Client: client})
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		if !tc.errorExpected && target.Foo != "bar" {
+			t.Errorf("%s: expecting decoded value %q, got %q", tc.name, "bar", target.Foo)
+		}
+	}
+}
+
+func TestTools_IsPrivateIP(t *testing.T) {
+	var tests = []struct {
+		ip      string
+		private bool
+	}{
+		{"8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"169.254.169.254", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::1", true},
+	}
+
+	for _, e := range tests {
+		if got := isPrivateIP(net.ParseIP(e.ip)); got != e.private {
+			t.Errorf("%s: expecting private %v, got %v", e.ip, e.private, got)
+		}
+	}
+}
+
+func TestTools_FetchJSON_AllowPrivateNetworks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"foo":"bar"}`))
+	}))
+	defer srv.Close()
+
+	var testTools Tools
+	var target struct {
+		Foo string `json:"foo"`
+	}
+
+	err := testTools.FetchJSON(srv.URL, &target, FetchOptions{})
+	if err == nil {
+		t.Error("expecting loopback test server to be rejected by default")
+	}
+
+	err = testTools.FetchJSON(srv.URL, &target, FetchOptions{AllowPrivateNetworks: true})
+	if err != nil {
+		t.Error("not expecting any error, got: ", err)
+	}
+
+	if target.Foo != "bar" {
+		t.Errorf("expecting decoded value %q, got %q", "bar", target.Foo)
+	}
+}
+
+func TestTools_WriteJSON_UploadedFile(t *testing.T) {
+	testTools := Tools{}
+	files := []*UploadedFile{
+		{OriginalFileName: "img.png", NewFileName: "abc.png", FileSize: 42, ThumbnailErr: errors.New("no space left"), FullPath: "/srv/uploads/abc.png", UploadDir: "/srv/uploads"},
+		{OriginalFileName: "doc.pdf", NewFileName: "def.pdf"},
+	}
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Data: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(rr.Body.String(), "/srv/uploads") {
+		t.Errorf("expecting the server paths to be left out, got %s", rr.Body.String())
+	}
+
+	var response struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{
+		"original_file_name", "new_file_name", "file_size", "content_type", "field_name",
+		"thumbnail_file_name", "thumbnail_error", "relative_path", "url",
+		"checksum", "image_width", "image_height", "duplicate",
+	}
+	for _, file := range response.Data {
+		if len(file) != len(keys) {
+			t.Errorf("expecting %d keys, got %d: %v", len(keys), len(file), file)
+		}
+		for _, key := range keys {
+			if _, ok := file[key]; !ok {
+				t.Errorf("expecting key %q, got %v", key, file)
+			}
+		}
+	}
+
+	if response.Data[0]["original_file_name"] != "img.png" || response.Data[0]["file_size"] != float64(42) {
+		t.Errorf("unexpected values %v", response.Data[0])
+	}
+	if response.Data[0]["thumbnail_error"] != "no space left" || response.Data[1]["thumbnail_error"] != "" {
+		t.Errorf("expecting thumbnail_error to be the message, got %v and %v", response.Data[0]["thumbnail_error"], response.Data[1]["thumbnail_error"])
+	}
+}
+
+func TestTools_WriteJSON_APIVersion(t *testing.T) {
+	testTools := Tools{APIVersion: "v2"}
+
+	for _, data := range []interface{}{JSONResponse{Message: "Foo"}, &JSONResponse{Message: "Foo"}} {
+		rr := httptest.NewRecorder()
+
+		err := testTools.WriteJSON(rr, http.StatusOK, data)
+		if err != nil {
+			t.Error("not expecting any error, got: ", err)
+		}
+
+		var payload map[string]interface{}
+		err = json.NewDecoder(rr.Body).Decode(&payload)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if payload["api_version"] != "v2" {
+			t.Errorf("expecting api_version %q, got %v", "v2", payload["api_version"])
+		}
+	}
+}
+
+func TestTools_ServeAndShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	started, finished := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte("done"))
+			close(finished)
+		}),
+	}
+
+	shutdownCalled := make(chan struct{})
+	srv.RegisterOnShutdown(func() {
+		close(shutdownCalled)
+	})
+
+	testTools := Tools{ShutdownTimeout: 5 * time.Second}
+	stopCh := make(chan os.Signal, 1)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- testTools.ServeAndShutdown(srv, stopCh)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		var res *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			res, err = http.Get("http://" + addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	stopCh <- os.Interrupt
+
+	err = <-result
+	if err != nil {
+		t.Error("not expecting any error, got: ", err)
+	}
+
+	select {
+	case <-shutdownCalled:
+	case <-time.After(time.Second):
+		t.Error("expecting Shutdown to be called")
+	}
+
+	select {
+	case <-finished:
+	default:
+		t.Error("expecting in-flight request to complete before ServeAndShutdown returns")
+	}
+
+	if b := <-body; b != "done" {
+		t.Errorf("expecting in-flight request to complete with %q, got %q", "done", b)
+	}
+}
+
+func TestTools_FormatTime(t *testing.T) {
+	tm := time.Date(2022, 7, 1, 10, 30, 15, 123456789, time.UTC)
+
+	testcases := []struct {
+		name     string
+		format   string
+		expected string
+	}{
+		{
+			name:     "default format",
+			format:   "",
+			expected: `{"error":false,"message":"","data":"2022-07-01T10:30:15.123456789Z"}`,
+		},
+		{
+			name:     "seconds precision",
+			format:   time.RFC3339,
+			expected: `{"error":false,"message":"","data":"2022-07-01T10:30:15Z"}`,
+		},
+		{
+			name:     "unix epoch",
+			format:   TimeFormatUnix,
+			expected: `{"error":false,"message":"","data":1656671415}`,
+		},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{TimeFormat: tc.format}
+		rr := httptest.NewRecorder()
+
+		err := testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Data: testTools.FormatTime(tm)})
+		if err != nil {
+			t.Errorf("%s: not expecting any error, got: %s", tc.name, err)
+		}
+
+		if got := strings.TrimSpace(rr.Body.String()); got != tc.expected {
+			t.Errorf("%s: expecting %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// testUploadPart describes a single file part sent by newUploadRequest
+type testUploadPart struct {
+	fieldName string
+	fileName  string
+	content   []byte
+}
+
+// newUploadRequest builds a multipart POST request containing the given file parts
+func newUploadRequest(t *testing.T, parts ...testUploadPart) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for _, p := range parts {
+		part, err := writer.CreateFormFile(p.fieldName, p.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = part.Write(p.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+
+	return request
+}
+
+// readTestFile returns the content of a file in testdata
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("./testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// inFlightStorage records the largest number of files being saved at the same time
+type inFlightStorage struct {
+	*memoryStorage
+	inFlight int32
+	max      int32
+}
+
+func (s *inFlightStorage) Save(ctx context.Context, name string, r io.Reader) (int64, error) {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+
+	// gives the other uploads a chance to start
+	time.Sleep(5 * time.Millisecond)
+	return s.memoryStorage.Save(ctx, name, r)
+}
+
+func TestTools_MaxConcurrentUploads(t *testing.T) {
+	testTools := Tools{
+		AllowedFileTypes:     []string{"image/png"},
+		MaxConcurrentUploads: 3,
+	}
+	uploadDir := t.TempDir()
+	img := readTestFile(t, "img.png")
+
+	// occupy every slot so the uploads have to wait for one to be freed
+	var releases []func()
+	for i := 0; i < testTools.MaxConcurrentUploads; i++ {
+		release, err := testTools.acquireUploadSlot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+
+	// the requests are built here, newUploadRequest can't fail the test from another goroutine
+	var requests []*http.Request
+	for i := 0; i < 20; i++ {
+		requests = append(requests, newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: img}))
+	}
+
+	var finished int32
+	errs := make(chan error, len(requests))
+	wg := sync.WaitGroup{}
+	for _, request := range requests {
+		wg.Add(1)
+		go func(request *http.Request) {
+			defer wg.Done()
+			_, err := testTools.UploadOneFile(request, uploadDir)
+			errs <- err
+			atomic.AddInt32(&finished, 1)
+		}(request)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&finished); n != 0 {
+		t.Errorf("expecting uploads to be throttled while all slots are taken, %d finished", n)
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 20 {
+		t.Errorf("expecting 20 uploaded files, got %d", len(entries))
+	}
+
+	// a cancelled request gives up waiting for a slot
+	for i := 0; i < testTools.MaxConcurrentUploads; i++ {
+		_, _ = testTools.acquireUploadSlot(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: img}).WithContext(ctx)
+	_, err = testTools.UploadOneFile(request, uploadDir)
+	if err == nil {
+		t.Error("expecting an error when the request is cancelled while waiting for a slot")
+	}
+
+	// no more than MaxConcurrentUploads files are written at once, and a change of the
+	// limit is followed
+	limited := Tools{AllowedFileTypes: []string{"image/png"}}
+	for _, limit := range []int{3, 1} {
+		storage := &inFlightStorage{memoryStorage: &memoryStorage{files: make(map[string][]byte)}}
+		limited.Storage = storage
+		limited.MaxConcurrentUploads = limit
+
+		var requests []*http.Request
+		for i := 0; i < 20; i++ {
+			requests = append(requests, newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: img}))
+		}
+
+		errs := make(chan error, len(requests))
+		for _, request := range requests {
+			go func(request *http.Request) {
+				_, err := limited.UploadOneFile(request, "")
+				errs <- err
+			}(request)
+		}
+		for range requests {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+
+		if max := atomic.LoadInt32(&storage.max); max > int32(limit) {
+			t.Errorf("expecting at most %d files saved at once, got %d", limit, max)
+		}
+	}
+}
+
+// slowReader returns at most chunk bytes per Read, sleeping delay before each one
+type slowReader struct {
+	r     io.Reader
+	chunk int
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	if len(p) > s.chunk {
+		p = p[:s.chunk]
+	}
+	return s.r.Read(p)
+}
+
+func TestTools_MinUploadSpeed(t *testing.T) {
+	img := readTestFile(t, "img.png")
+
+	testcases := []struct {
+		name          string
+		slow          bool
+		errorExpected bool
+	}{
+		{
+			name:          "normal speed",
+			slow:          false,
+			errorExpected: false,
+		},
+		{
+			name:          "slow loris",
+			slow:          true,
+			errorExpected: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{
+			AllowedFileTypes:     []string{"image/png"},
+			MinUploadSpeed:       10 * 1024,
+			MinUploadSpeedWindow: 50 * time.Millisecond,
+		}
+
+		request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: img})
+		if tc.slow {
+			request.Body = ioutil.NopCloser(&slowReader{r: request.Body, chunk: 10, delay: 10 * time.Millisecond})
+		}
+
+		_, err := testTools.UploadFiles(request, t.TempDir())
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if tc.errorExpected && !errors.Is(err, ErrUploadTooSlow) {
+			t.Errorf("%s: expecting ErrUploadTooSlow, got %v", tc.name, err)
+		}
+	}
+}
+
+// burstReader returns chunk bytes at once every period
+type burstReader struct {
+	r      io.Reader
+	chunk  int
+	period time.Duration
+	next   time.Time
+}
+
+func (b *burstReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Until(b.next))
+	b.next = time.Now().Add(b.period)
+	if len(p) > b.chunk {
+		p = p[:b.chunk]
+	}
+	return io.ReadFull(b.r, p)
+}
+
+func TestTools_MinUploadSpeedSlidingWindow(t *testing.T) {
+	img := readTestFile(t, "img.png")
+	testTools := Tools{
+		AllowedFileTypes:     []string{"image/png"},
+		MinUploadSpeed:       10 * 1024,
+		MinUploadSpeedWindow: 50 * time.Millisecond,
+	}
+
+	// on average fast enough, but nothing is received for half a window after each burst
+	request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: img})
+	request.Body = io.NopCloser(&burstReader{r: request.Body, chunk: 4096, period: 75 * time.Millisecond})
+	_, err := testTools.UploadFiles(request, t.TempDir())
+	if !errors.Is(err, ErrUploadTooSlow) {
+		t.Errorf("expecting a bursting client to fail, got %v", err)
+	}
+
+	// a client sending nothing fails instead of blocking
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	request = newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: img})
+	request.Body = io.NopCloser(io.MultiReader(io.LimitReader(request.Body, 1024), pr))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := testTools.UploadFiles(request, t.TempDir())
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if !errors.Is(err, ErrUploadTooSlow) {
+			t.Errorf("expecting a stalled client to fail, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting a stalled client to fail, the upload is still blocked")
+	}
+}
+
+func TestTools_ErrorJSON_DevMode(t *testing.T) {
+	testTools := Tools{DevMode: true}
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorJSON(rr, errors.New("test error"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !strings.Contains(rr.Body.String(), "{\n  \"error\": true,\n  \"message\": \"test error\"") {
+		t.Errorf("expecting indented JSON, got %q", rr.Body.String())
+	}
+
+	testTools.DevMode = false
+	rr = httptest.NewRecorder()
+	err = testTools.ErrorJSON(rr, errors.New("test error"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if strings.Count(rr.Body.String(), "\n") != 1 {
+		t.Errorf("expecting compact JSON, got %q", rr.Body.String())
+	}
+}
+
+func TestTools_MergeJSON(t *testing.T) {
+	type user struct {
+		Name    string            `json:"name"`
+		Address map[string]string `json:"address"`
+	}
+
+	first := user{Name: "foo", Address: map[string]string{"city": "Jakarta", "zip": "10110"}}
+	second := map[string]interface{}{"name": "bar", "address": map[string]string{"city": "Bandung"}}
+
+	testcases := []struct {
+		name         string
+		deep         bool
+		expectedName string
+		expectedZip  interface{}
+	}{
+		{
+			name:         "shallow override",
+			deep:         false,
+			expectedName: "bar",
+			expectedZip:  nil,
+		},
+		{
+			name:         "deep merge",
+			deep:         true,
+			expectedName: "bar",
+			expectedZip:  "10110",
+		},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{DeepMergeJSON: tc.deep}
+
+		merged, err := testTools.MergeJSON(first, second)
+		if err != nil {
+			t.Errorf("%s: not expecting any error, got: %s", tc.name, err)
+			continue
+		}
+
+		if merged["name"] != tc.expectedName {
+			t.Errorf("%s: expecting name %q, got %v", tc.name, tc.expectedName, merged["name"])
+		}
+
+		address := merged["address"].(map[string]interface{})
+		if address["city"] != "Bandung" {
+			t.Errorf("%s: expecting city %q, got %v", tc.name, "Bandung", address["city"])
+		}
+
+		if address["zip"] != tc.expectedZip {
+			t.Errorf("%s: expecting zip %v, got %v", tc.name, tc.expectedZip, address["zip"])
+		}
+	}
+
+	var testTools Tools
+	_, err := testTools.MergeJSON(first, []string{"not", "an", "object"})
+	if err == nil {
+		t.Error("expecting an error when merging a non object value")
+	}
+}
+
+func TestTools_UploadFilesWithSummary(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png", "image/jpeg"}}
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t,
+		testUploadPart{fieldName: "first", fileName: "img.png", content: readTestFile(t, "img.png")},
+		testUploadPart{fieldName: "second", fileName: "notes.txt", content: []byte("just some plain text")},
+		testUploadPart{fieldName: "third", fileName: "pic.jpg", content: readTestFile(t, "pic.jpg")},
+	)
+
+	summary, err := testTools.UploadFilesWithSummary(request, uploadDir, UploadOptions{})
+	if err != nil {
+		t.Fatal("not expecting any error, got: ", err)
+	}
+
+	if len(summary.Uploaded) != 2 {
+		t.Errorf("expecting 2 uploaded files, got %d", len(summary.Uploaded))
+	}
+
+	if len(summary.Skipped) != 1 || summary.Skipped[0] != "notes.txt" {
+		t.Errorf("expecting notes.txt to be skipped, got %v", summary.Skipped)
+	}
+
+	if len(summary.Errors) != 0 {
+		t.Errorf("expecting no errors, got %v", summary.Errors)
+	}
+
+	// the fields of the parsed form are visited in name order
+	if len(summary.Uploaded) == 2 && (summary.Uploaded[0].OriginalFileName != "img.png" || summary.Uploaded[1].OriginalFileName != "pic.jpg") {
+		t.Errorf("expecting img.png then pic.jpg, got %s then %s", summary.Uploaded[0].OriginalFileName, summary.Uploaded[1].OriginalFileName)
+	}
+
+	for _, f := range summary.Uploaded {
+		if _, err := os.Stat(filepath.Join(uploadDir, f.NewFileName)); os.IsNotExist(err) {
+			t.Errorf("expected file to exist: %s", f.NewFileName)
+		}
+	}
+}
+
+func TestTools_RequiredAspectRatio(t *testing.T) {
+	testcases := []struct {
+		name          string
+		ratio         AspectRatio
+		fileName      string
+		content       []byte
+		errorExpected bool
+	}{
+		{
+			name:          "conforming image",
+			ratio:         AspectRatio{Width: 3, Height: 2, Tolerance: 0.01},
+			fileName:      "img.png",
+			content:       readTestFile(t, "img.png"),
+			errorExpected: false,
+		},
+		{
+			name:          "non conforming image",
+			ratio:         AspectRatio{Width: 16, Height: 9, Tolerance: 0.01},
+			fileName:      "img.png",
+			content:       readTestFile(t, "img.png"),
+			errorExpected: true,
+		},
+		{
+			name:          "non image upload",
+			ratio:         AspectRatio{Width: 16, Height: 9, Tolerance: 0.01},
+			fileName:      "notes.txt",
+			content:       []byte(strings.Repeat("just some plain text ", 50)),
+			errorExpected: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		ratio := tc.ratio
+		testTools := Tools{
+			AllowedFileTypes:    []string{"image/png", "text/plain; charset=utf-8"},
+			RequiredAspectRatio: &ratio,
+		}
+
+		request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: tc.fileName, content: tc.content})
+
+		_, err := testTools.UploadFiles(request, t.TempDir())
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+	}
+}
+
+func TestTools_ErrorJSON_JoinedErrors(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorJSON(rr, errors.Join(errors.New("name is required"), errors.New("email is invalid")))
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload struct {
+		Error   bool     `json:"error"`
+		Message string   `json:"message"`
+		Data    []string `json:"data"`
+	}
+	err = json.NewDecoder(rr.Body).Decode(&payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(payload.Message, "\n") {
+		t.Errorf("expecting a single line message, got %q", payload.Message)
+	}
+
+	if len(payload.Data) != 2 || payload.Data[0] != "name is required" || payload.Data[1] != "email is invalid" {
+		t.Errorf("expecting both error messages in data, got %v", payload.Data)
+	}
+}
+
+func TestTools_ReplayResponse(t *testing.T) {
+	var testTools Tools
+
+	captured := httptest.NewRecorder()
+	err := testTools.WriteJSON(captured, http.StatusCreated, JSONResponse{Message: "Foo"}, http.Header{"X-Cache": []string{"MISS"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := &CachedResponse{
+		StatusCode: captured.Code,
+		Header:     captured.Header().Clone(),
+		Body:       captured.Body.Bytes(),
+		CachedAt:   time.Now(),
+	}
+
+	// Age is expressed in seconds, so pretend the response was cached a while ago
+	cached.CachedAt = cached.CachedAt.Add(-2 * time.Second)
+
+	rr := httptest.NewRecorder()
+	err = testTools.ReplayResponse(rr, cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expecting status %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	if rr.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expecting X-Cache header %q, got %q", "HIT", rr.Header().Get("X-Cache"))
+	}
+
+	if age, _ := strconv.Atoi(rr.Header().Get("Age")); age < 2 {
+		t.Errorf("expecting Age of at least 2 seconds, got %q", rr.Header().Get("Age"))
+	}
+
+	if rr.Body.String() != captured.Body.String() {
+		t.Errorf("expecting body %q, got %q", captured.Body.String(), rr.Body.String())
+	}
+}
+
+func TestTools_PushJSONToRemote_MarshalFunc(t *testing.T) {
+	var body []byte
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		body, _ = io.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("ok")),
+			Header:     http.Header{},
+		}
+	})
+
+	testTools := Tools{
+		MarshalFunc: func(v interface{}) ([]byte, error) {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+
+			var m map[string]interface{}
+			err = json.Unmarshal(b, &m)
+			if err != nil {
+				return nil, err
+			}
+			m["_toolkit"] = true
+
+			return json.Marshal(m)
+		},
+	}
+
+	var foo struct {
+		Bar string `json:"bar"`
+	}
+	foo.Bar = "bar"
+
+	_, err := testTools.PushJSONToRemote("http://example.some.path", foo, client)
+	if err != nil {
+		t.Fatal("There should be no error: ", err)
+	}
+
+	var sent map[string]interface{}
+	err = json.Unmarshal(body, &sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent["_toolkit"] != true || sent["bar"] != "bar" {
+		t.Errorf("expecting body to be serialized with MarshalFunc, got %s", body)
+	}
+}
+
+func TestTools_DuplicateFileNames(t *testing.T) {
+	img := readTestFile(t, "img.png")
+
+	testcases := []struct {
+		name          string
+		policy        DuplicatePolicy
+		expectedFiles []string
+		errorExpected bool
+	}{
+		{
+			name:          "overwrite",
+			policy:        DuplicateOverwrite,
+			expectedFiles: []string{"img.png"},
+			errorExpected: false,
+		},
+		{
+			name:          "error",
+			policy:        DuplicateError,
+			errorExpected: true,
+		},
+		{
+			name:          "suffix",
+			policy:        DuplicateSuffix,
+			expectedFiles: []string{"img-1.png", "img.png"},
+			errorExpected: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{
+			AllowedFileTypes:   []string{"image/png"},
+			DuplicateFileNames: tc.policy,
+		}
+		uploadDir := t.TempDir()
+
+		request := newUploadRequest(t,
+			testUploadPart{fieldName: "file", fileName: "img.png", content: img},
+			testUploadPart{fieldName: "file", fileName: "img.png", content: img},
+		)
+
+		_, err := testTools.UploadFiles(request, uploadDir, false)
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		if tc.errorExpected {
+			continue
+		}
+
+		var names []string
+		entries, _ := os.ReadDir(uploadDir)
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+
+		if strings.Join(names, ",") != strings.Join(tc.expectedFiles, ",") {
+			t.Errorf("%s: expecting files %v, got %v", tc.name, tc.expectedFiles, names)
+		}
+	}
+}
+
+func TestTools_ReadJSON_WithMaxJSONSize(t *testing.T) {
+	testTools := Tools{MaxJSONSize: 10}
+	body := `{"foo":"this body is longer than ten bytes"}`
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err := testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+	if err == nil {
+		t.Error("expecting the global limit to reject the body")
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req = req.WithContext(WithMaxJSONSize(req.Context(), 1024*1024))
+	err = testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+	if err != nil {
+		t.Error("expecting the context override to allow the body, got: ", err)
+	}
+}
+
+func TestTools_UploadFilesStreaming(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+	request := newUploadRequest(t,
+		testUploadPart{fieldName: "file", fileName: "img.png", content: readTestFile(t, "img.png")},
+		testUploadPart{fieldName: "file", fileName: "pic.jpg", content: readTestFile(t, "pic.jpg")},
+	)
+
+	events, err := testTools.UploadFilesStreaming(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		eventType UploadEventType
+		fileName  string
+	}{
+		{UploadStarted, "img.png"},
+		{UploadCompleted, "img.png"},
+		{UploadStarted, "pic.jpg"},
+		{UploadFailed, "pic.jpg"},
+	}
+
+	var got []UploadEvent
+	for e := range events {
+		got = append(got, e)
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("expecting %d events, got %d", len(expected), len(got))
+	}
+
+	for i, e := range expected {
+		if got[i].Type != e.eventType || got[i].OriginalFileName != e.fileName {
+			t.Errorf("event %d: expecting type %d for %s, got type %d for %s", i, e.eventType, e.fileName, got[i].Type, got[i].OriginalFileName)
+		}
+	}
+
+	if got[1].File == nil {
+		t.Error("expecting completed event to carry the uploaded file")
+	}
+
+	if got[3].Err == nil {
+		t.Error("expecting failed event to carry the error")
+	}
+}
+
+func TestTools_IsSlug(t *testing.T) {
+	var testTool Tools
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected bool
+	}{
+		{name: "clean slug", input: "this-is-a-slug-123", expected: true},
+		{name: "uppercase", input: "This-Is-A-Slug", expected: false},
+		{name: "spaces", input: "this is a slug", expected: false},
+		{name: "leading separator", input: "-slug", expected: false},
+		{name: "empty", input: "", expected: false},
+	}
+
+	for _, tc := range testCases {
+		if got := testTool.IsSlug(tc.input); got != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestTools_Slugify_StopWords(t *testing.T) {
+	testTool := Tools{SlugStopWords: []string{"the", "of"}}
+
+	got, err := testTool.Slugify("The Art of Go")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if got != "art-go" {
+		t.Errorf("expected %q, got %q", "art-go", got)
+	}
+
+	got, err = testTool.Slugify("theory of other things")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if got != "theory-other-things" {
+		t.Errorf("expected only whole words to be removed, got %q", got)
+	}
+
+	_, err = testTool.Slugify("The of THE")
+	if !errors.Is(err, ErrSlugIsEmpty) {
+		t.Errorf("expected ErrSlugIsEmpty, got %v", err)
+	}
+}
+
+func TestTools_WriteJSON_JSONIndent(t *testing.T) {
+	testTools := Tools{JSONIndent: "\t"}
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Message: "Foo"})
+	if err != nil {
+		t.Error("not expecting any error, got: ", err)
+	}
+
+	if !strings.Contains(rr.Body.String(), "\n\t\"message\": \"Foo\"") {
+		t.Errorf("expecting tab indented JSON, got %q", rr.Body.String())
+	}
+}
+
+func TestTools_UploadFiles_PublicBaseURL(t *testing.T) {
+	testTools := Tools{
+		AllowedFileTypes: []string{"image/png"},
+		PublicBaseURL:    "https://cdn.example.com/uploads/",
+	}
+
+	request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "my img.png", content: readTestFile(t, "img.png")})
+
+	file, err := testTools.UploadOneFile(request, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.URL != "https://cdn.example.com/uploads/my%20img.png" {
+		t.Errorf("expecting URL %q, got %q", "https://cdn.example.com/uploads/my%20img.png", file.URL)
+	}
+}
+
+func TestTools_StreamJSONArray(t *testing.T) {
+	var elements []string
+	for i := 0; i < 1000; i++ {
+		elements = append(elements, fmt.Sprintf(`{"id":%d}`, i))
+	}
+	body := "[" + strings.Join(elements, ",") + "]"
+
+	var testTools Tools
+
+	count := 0
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err := testTools.StreamJSONArray(req, func(raw json.RawMessage) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Error("not expecting any error, got: ", err)
+	}
+
+	if count != 1000 {
+		t.Errorf("expecting fn to be called 1000 times, got %d", count)
+	}
+
+	stop := errors.New("stop")
+	count = 0
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.StreamJSONArray(req, func(raw json.RawMessage) error {
+		count++
+		if count == 500 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("expecting the error from fn, got %v", err)
+	}
+
+	if count != 500 {
+		t.Errorf("expecting processing to stop at element 500, got %d", count)
+	}
+
+	testTools.MaxJSONSize = 5
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.StreamJSONArray(req, func(raw json.RawMessage) error { return nil })
+	if err == nil {
+		t.Error("expecting an error for elements larger than MaxJSONSize")
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"id":1}`))
+	err = testTools.StreamJSONArray(req, func(raw json.RawMessage) error { return nil })
+	if err == nil {
+		t.Error("expecting an error for a body which is not an array")
+	}
+
+	// a single huge element is rejected before it is read into memory
+	testTools = Tools{MaxJSONSize: 1024, RequestSizeLimit: 64 << 20}
+	huge := &countingReader{r: io.NopCloser(strings.NewReader(`[{"id":1},"` + strings.Repeat("a", 16<<20) + `"]`))}
+	count = 0
+	req = httptest.NewRequest("POST", "/", huge)
+	err = testTools.StreamJSONArray(req, func(raw json.RawMessage) error {
+		count++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "element 1 must not be larger than 1024 bytes") {
+		t.Errorf("expecting the huge element to be rejected, got %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("expecting fn to be called for the first element only, got %d", count)
+	}
+
+	if huge.n > 64<<10 {
+		t.Errorf("expecting the huge element not to be read, %d bytes were read", huge.n)
+	}
+
+	// the body is limited by jsonSizeLimit
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req = req.WithContext(WithMaxJSONSize(req.Context(), 100))
+	err = testTools.StreamJSONArray(req, func(raw json.RawMessage) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "body must not be larger than 100 bytes") {
+		t.Errorf("expecting the body to be limited by WithMaxJSONSize, got %v", err)
+	}
+}
+
+func TestTools_RemoteError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/bad":
+			_, _ = w.Write([]byte("not json"))
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+
+	testcases := []struct {
+		name         string
+		path         string
+		expectedKind RemoteErrorKind
+		expectedCode int
+	}{
+		{name: "timeout", path: "/slow", expectedKind: RemoteErrorTimeout, expectedCode: 0},
+		{name: "server error", path: "/fail", expectedKind: RemoteErrorStatus, expectedCode: http.StatusInternalServerError},
+		{name: "decode error", path: "/bad", expectedKind: RemoteErrorDecode, expectedCode: http.StatusOK},
+	}
+
+	var testTools Tools
+
+	for _, tc := range testcases {
+		var target map[string]interface{}
+		err := testTools.FetchJSON(srv.URL+tc.path, &target, FetchOptions{AllowPrivateNetworks: true, Client: client})
+
+		var remoteErr *RemoteError
+		if !errors.As(err, &remoteErr) {
+			t.Errorf("%s: expecting a RemoteError, got %v", tc.name, err)
+			continue
+		}
+
+		if remoteErr.Kind != tc.expectedKind {
+			t.Errorf("%s: expecting kind %d, got %d", tc.name, tc.expectedKind, remoteErr.Kind)
+		}
+
+		if remoteErr.StatusCode != tc.expectedCode {
+			t.Errorf("%s: expecting status %d, got %d", tc.name, tc.expectedCode, remoteErr.StatusCode)
+		}
+	}
+
+	_, err := testTools.PushJSONToRemote(srv.URL+"/slow", map[string]string{"foo": "bar"}, client)
+
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || !remoteErr.Timeout() {
+		t.Errorf("expecting PushJSONToRemote to return a timeout RemoteError, got %v", err)
+	}
+
+	// error statuses are left to the caller by default
+	res, err := testTools.PushJSONToRemote(srv.URL+"/fail", map[string]string{"foo": "bar"}, client)
+	if err != nil {
+		t.Fatal("not expecting any error, got: ", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expecting status %d, got %d", http.StatusInternalServerError, res.StatusCode)
+	}
+
+	testTools.PushRequireSuccess = true
+	res, err = testTools.PushJSONToRemote(srv.URL+"/fail", map[string]string{"foo": "bar"}, client)
+	if res != nil {
+		t.Error("expecting no response with PushRequireSuccess and a failing status")
+	}
+	if !errors.As(err, &remoteErr) || remoteErr.Kind != RemoteErrorStatus || remoteErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expecting a RemoteErrorStatus RemoteError with status 500, got %v", err)
+	}
+
+	res, err = testTools.PushJSONToRemote(srv.URL+"/", map[string]string{"foo": "bar"}, client)
+	if err != nil {
+		t.Error("not expecting any error for a 2xx status, got: ", err)
+	} else {
+		_ = res.Body.Close()
+	}
+}
+
+func TestTools_WriteJSON_DefaultResponseHeaders(t *testing.T) {
+	testTools := Tools{
+		DefaultResponseHeaders: http.Header{
+			"X-Content-Type-Options": []string{"nosniff"},
+			"X-Api-Version":          []string{"2"},
+		},
+	}
+
+	header := http.Header{}
+	header.Set("FOO", "BAR")
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Message: "Foo"}, header)
+	if err != nil {
+		t.Error("not expecting any error, got: ", err)
+	}
+
+	if rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("expecting header X-Content-Type-Options to be %q, got %q", "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	}
+
+	if rr.Header().Get("X-Api-Version") != "2" {
+		t.Errorf("expecting header X-Api-Version to be %q, got %q", "2", rr.Header().Get("X-Api-Version"))
+	}
+
+	if rr.Header().Get("FOO") != "BAR" {
+		t.Errorf("expecting header FOO to be %q, got %q", "BAR", rr.Header().Get("FOO"))
+	}
+
+	rr = httptest.NewRecorder()
+	err = testTools.ErrorJSON(rr, errors.New("test error"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("expecting ErrorJSON to send the default headers")
+	}
+}
+
+func TestTools_InferAllowedExtensions(t *testing.T) {
+	img := readTestFile(t, "img.png")
+
+	testcases := []struct {
+		name          string
+		fileName      string
+		infer         bool
+		extraTypes    map[string]string
+		errorExpected bool
+	}{
+		{name: "matching extension", fileName: "img.png", infer: true, errorExpected: false},
+		{name: "uppercase extension", fileName: "img.PNG", infer: true, errorExpected: false},
+		{name: "mismatched extension", fileName: "img.exe", infer: true, errorExpected: true},
+		{name: "mismatched extension without flag", fileName: "img.exe", infer: false, errorExpected: false},
+		{name: "registered extension", fileName: "img.apng", infer: true, extraTypes: map[string]string{".apng": "image/png"}, errorExpected: false},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{
+			AllowedFileTypes:       []string{"image/png"},
+			InferAllowedExtensions: tc.infer,
+			ExtensionContentTypes:  tc.extraTypes,
+		}
+
+		request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: tc.fileName, content: img})
+
+		_, err := testTools.UploadFiles(request, t.TempDir())
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		var uploadErr *UploadError
+		if tc.errorExpected && (!errors.As(err, &uploadErr) || uploadErr.Reason != UploadErrorTypeNotPermitted) {
+			t.Errorf("%s: expecting UploadErrorTypeNotPermitted, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestTools_SizeOf(t *testing.T) {
+	var testTools Tools
+
+	small := JSONResponse{}
+	large := JSONResponse{Message: "Foo", Data: strings.Repeat("bar", 100)}
+
+	if got := testTools.SizeOf(small); got <= 0 {
+		t.Errorf("expecting a positive size, got %d", got)
+	}
+
+	if testTools.SizeOf(large) <= testTools.SizeOf(small) {
+		t.Error("expecting a larger value to have a larger size")
+	}
+
+	if got := testTools.SizeOf(make(chan int)); got != -1 {
+		t.Errorf("expecting -1 for a value which can't be encoded, got %d", got)
+	}
+
+	if testTools.UnsafeSizeOf(small) == 0 {
+		t.Error("expecting a positive in-memory size")
+	}
+
+	if testTools.UnsafeSizeOf(large) < testTools.UnsafeSizeOf(small)+300 {
+		t.Error("expecting the in-memory size to include referenced strings")
+	}
+
+	type node struct {
+		Next *node
+	}
+	cyclic := &node{}
+	cyclic.Next = cyclic
+
+	if testTools.UnsafeSizeOf(cyclic) == 0 {
+		t.Error("expecting a positive in-memory size for a cyclic value")
+	}
+}
+
+// signTestJWT builds a HS256 token holding claims
+func signTestJWT(t *testing.T, claims map[string]interface{}, secret []byte) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTools_ParseJWT(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now().Unix()
+
+	valid := signTestJWT(t, map[string]interface{}{"sub": "42", "exp": now + 60, "nbf": now - 60}, secret)
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","exp":`+fmt.Sprint(now+60)+`}`)) + "." + parts[2]
+
+	testcases := []struct {
+		name        string
+		token       string
+		expectedErr error
+	}{
+		{name: "valid token", token: valid, expectedErr: nil},
+		{name: "expired token", token: signTestJWT(t, map[string]interface{}{"exp": now - 60}, secret), expectedErr: ErrTokenExpired},
+		{name: "not yet valid token", token: signTestJWT(t, map[string]interface{}{"nbf": now + 60}, secret), expectedErr: ErrTokenNotYetValid},
+		{name: "tampered signature", token: tampered, expectedErr: ErrInvalidToken},
+		{name: "wrong secret", token: signTestJWT(t, map[string]interface{}{"sub": "42"}, []byte("other")), expectedErr: ErrInvalidToken},
+		{name: "malformed token", token: "not.a.token.at.all", expectedErr: ErrInvalidToken},
+	}
+
+	var testTools Tools
+
+	for _, tc := range testcases {
+		claims, err := testTools.ParseJWT(tc.token, secret)
+		if !errors.Is(err, tc.expectedErr) {
+			t.Errorf("%s: expecting error %v, got %v", tc.name, tc.expectedErr, err)
+		}
+
+		if tc.expectedErr == nil && claims["sub"] != "42" {
+			t.Errorf("%s: expecting sub claim %q, got %v", tc.name, "42", claims["sub"])
+		}
+	}
+}
+
+func TestTools_UploadFilesWithMapping(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png", "image/jpeg"}}
+
+	baseDir := t.TempDir()
+	photoDir := filepath.Join(baseDir, "photos")
+	docDir := filepath.Join(baseDir, "docs")
+	defaultDir := filepath.Join(baseDir, "other")
+
+	request := newUploadRequest(t,
+		testUploadPart{fieldName: "profile_photo", fileName: "img.png", content: readTestFile(t, "img.png")},
+		testUploadPart{fieldName: "document", fileName: "pic.jpg", content: readTestFile(t, "pic.jpg")},
+		testUploadPart{fieldName: "unmapped", fileName: "img.png", content: readTestFile(t, "img.png")},
+	)
+
+	summary, err := testTools.UploadFilesWithMapping(request, map[string]string{
+		"profile_photo": photoDir,
+		"document":      docDir,
+	}, UploadOptions{KeepFileName: true, DefaultDir: defaultDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.Uploaded) != 3 {
+		t.Errorf("expecting 3 uploaded files, got %d", len(summary.Uploaded))
+	}
+
+	for _, p := range []string{filepath.Join(photoDir, "img.png"), filepath.Join(docDir, "pic.jpg"), filepath.Join(defaultDir, "img.png")} {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			t.Errorf("expected file to exist: %s", p)
+		}
+	}
+
+	// without DefaultDir the unmapped field has nowhere to go
+	request = newUploadRequest(t, testUploadPart{fieldName: "unmapped", fileName: "img.png", content: readTestFile(t, "img.png")})
+	summary, err = testTools.UploadFilesWithMapping(request, map[string]string{"document": docDir}, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.Errors) != 1 || summary.Errors[0].FileName != "img.png" || summary.Errors[0].Reason != UploadErrorOther {
+		t.Errorf("expecting an UploadError for the unmapped img.png, got %v", summary.Errors)
+	}
+
+	// the upload field restrictions apply like in UploadFilesWithSummary
+	testTools.UploadFieldName = "profile_photo"
+	testTools.RejectUnexpectedUploadFields = true
+	request = newUploadRequest(t,
+		testUploadPart{fieldName: "profile_photo", fileName: "img.png", content: readTestFile(t, "img.png")},
+		testUploadPart{fieldName: "document", fileName: "pic.jpg", content: readTestFile(t, "pic.jpg")},
+	)
+	_, err = testTools.UploadFilesWithMapping(request, map[string]string{"profile_photo": photoDir, "document": docDir}, UploadOptions{})
+	if !errors.Is(err, ErrUnexpectedUploadField) {
+		t.Errorf("expecting ErrUnexpectedUploadField, got %v", err)
+	}
+}
+
+func TestTools_ErrorJSONRateLimited(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorJSONRateLimited(rr, 1500*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	if rr.Header().Get("Retry-After") != "2" {
+		t.Errorf("expected Retry-After %q, got %q", "2", rr.Header().Get("Retry-After"))
+	}
+
+	var payload JSONResponse
+	err = json.NewDecoder(rr.Body).Decode(&payload)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !payload.Error || payload.Message == "" {
+		t.Errorf("expected a JSON error, got %+v", payload)
+	}
+}
+
+func TestTools_WriteJSON_WebhookSecret(t *testing.T) {
+	testTools := Tools{WebhookSecret: "secret"}
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Message: "Foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(rr.Body.Bytes())
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := rr.Header().Get("X-Webhook-Signature"); got != expected {
+		t.Errorf("expecting signature %q, got %q", expected, got)
+	}
+
+	testTools.WebhookSecret = ""
+	rr = httptest.NewRecorder()
+	err = testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Message: "Foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("X-Webhook-Signature") != "" {
+		t.Error("expecting no signature without a secret")
+	}
+}
+
+func TestTools_ValidatePDFs(t *testing.T) {
+	body := "1 0 obj << /Type /Catalog >> endobj\n" + strings.Repeat("% padding\n", 60)
+	validPDF := "%PDF-1.4\n" + body + "trailer << /Root 1 0 R >>\n%%EOF\n"
+
+	testcases := []struct {
+		name          string
+		content       string
+		rejectEncrypt bool
+		errorExpected bool
+	}{
+		{name: "valid pdf", content: validPDF, errorExpected: false},
+		{name: "truncated pdf", content: "%PDF-1.4\n" + body, errorExpected: true},
+		{name: "encrypted pdf allowed", content: "%PDF-1.4\n/Encrypt 2 0 R\n" + body + "%%EOF", rejectEncrypt: false, errorExpected: false},
+		{name: "encrypted pdf rejected", content: "%PDF-1.4\n/Encrypt 2 0 R\n" + body + "%%EOF", rejectEncrypt: true, errorExpected: true},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{
+			AllowedFileTypes:    []string{"application/pdf"},
+			ValidatePDFs:        true,
+			RejectEncryptedPDFs: tc.rejectEncrypt,
+		}
+		uploadDir := t.TempDir()
+
+		request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "doc.pdf", content: []byte(tc.content)})
+
+		_, err := testTools.UploadFiles(request, uploadDir, false)
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		_, statErr := os.Stat(filepath.Join(uploadDir, "doc.pdf"))
+		if tc.errorExpected && !os.IsNotExist(statErr) {
+			t.Errorf("%s: expecting rejected file to be removed", tc.name)
+		}
+	}
+}
+
+func TestTools_RequestSizeLimit(t *testing.T) {
+	testTools := Tools{RequestSizeLimit: 100, MaxJSONSize: 1024}
+	body := `{"foo":"` + strings.Repeat("a", 190) + `"}`
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err := testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+	if err == nil || !strings.Contains(err.Error(), "100 bytes") {
+		t.Errorf("expecting an error referencing the 100 byte limit, got %v", err)
+	}
+
+	var handlerErr error
+	handler := testTools.MaxBytesMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, handlerErr = io.ReadAll(r.Body)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if handlerErr == nil {
+		t.Error("expecting the middleware to limit the body to 100 bytes")
+	}
+}
+
+func TestTools_DirectorySize(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]int{
+		filepath.Join(dir, "a.txt"):           100,
+		filepath.Join(dir, "nested", "b.txt"): 250,
+		filepath.Join(outside, "c.txt"):       1000,
+	}
+	for name, size := range files {
+		err = os.WriteFile(name, bytes.Repeat([]byte("x"), size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a link pointing outside of the tree must not be followed
+	_ = os.Symlink(outside, filepath.Join(dir, "link"))
+
+	size, err := testTools.DirectorySize(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 350 {
+		t.Errorf("expecting directory size of 350, got %d", size)
+	}
+
+	_, err = testTools.DirectorySize(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Error("expecting an error for a missing directory")
+	}
+}
+
+func TestTools_Write(t *testing.T) {
+	var testTools Tools
+
+	testcases := []struct {
+		name           string
+		accept         string
+		result         Result
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "ok as json",
+			accept:         "application/json",
+			result:         Ok("Bar"),
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"error":false,"message":"","data":"Bar"}`,
+		},
+		{
+			name:           "fail as json",
+			accept:         "",
+			result:         Fail(errors.New("not found"), http.StatusNotFound),
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"error":true,"message":"not found"}`,
+		},
+		{
+			name:           "ok as xml",
+			accept:         "application/xml, application/json;q=0.9",
+			result:         Ok("Bar"),
+			expectedStatus: http.StatusOK,
+			expectedBody:   xml.Header + `<response><error>false</error><message></message><data>Bar</data></response>`,
+		},
+		{
+			name:           "fail as xml",
+			accept:         "text/xml",
+			result:         Fail(errors.New("not found"), http.StatusNotFound),
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   xml.Header + `<response><error>true</error><message>not found</message></response>`,
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", tc.accept)
+		rr := httptest.NewRecorder()
+
+		err := testTools.Write(rr, req, tc.result)
+		if err != nil {
+			t.Errorf("%s: not expecting any error, got: %s", tc.name, err)
+		}
+
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: expecting status %d, got %d", tc.name, tc.expectedStatus, rr.Code)
+		}
+
+		if got := strings.TrimSpace(rr.Body.String()); got != tc.expectedBody {
+			t.Errorf("%s: expecting body %s, got %s", tc.name, tc.expectedBody, got)
+		}
+	}
+}
+
+func TestTools_ReadJSON_AllowTrailingData(t *testing.T) {
+	testcases := []struct {
+		name          string
+		allowTrailing bool
+		errorExpected bool
+	}{
+		{name: "trailing data rejected by default", allowTrailing: false, errorExpected: true},
+		{name: "trailing data tolerated", allowTrailing: true, errorExpected: false},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{AllowTrailingData: tc.allowTrailing}
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"foo":"bar"}{"foo":"baz"}`))
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		if !tc.errorExpected && decodedJSON.Foo != "bar" {
+			t.Errorf("%s: expecting the first value to be decoded, got %q", tc.name, decodedJSON.Foo)
+		}
+	}
+}
+
+func TestTools_TOTP(t *testing.T) {
+	var testTools Tools
+
+	// RFC 6238 SHA1 test vectors, truncated to 6 digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range vectors {
+		code, err := testTools.TOTPCode(secret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != v.expected {
+			t.Errorf("at %d: expecting code %s, got %s", v.unix, v.expected, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	previous, _ := testTools.TOTPCode(secret, now.Add(-30*time.Second))
+
+	if !testTools.ValidateTOTP(secret, "081804", now, 0) {
+		t.Error("expecting the current code to be valid")
+	}
+
+	if testTools.ValidateTOTP(secret, previous, now, 0) {
+		t.Error("expecting the previous code to be invalid without skew")
+	}
+
+	if !testTools.ValidateTOTP(secret, previous, now, 1) {
+		t.Error("expecting the previous code to be valid with a skew of 1")
+	}
+
+	generated, err := testTools.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testTools.TOTPCode(generated, now); err != nil {
+		t.Error("expecting a generated secret to be usable, got: ", err)
+	}
+
+	if _, err := testTools.TOTPCode("not base32!", now); err == nil {
+		t.Error("expecting an error for an invalid secret")
+	}
+}
+
+func TestTools_DownloadStaticFile_UnicodeName(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	var testTool Tools
+
+	testTool.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "résumé.jpg")
+
+	res := rr.Result()
+	defer res.Body.Close()
+
+	expected := "attachment; filename=\"r_sum_.jpg\"; filename*=UTF-8''r%C3%A9sum%C3%A9.jpg"
+	if res.Header.Get("Content-Disposition") != expected {
+		t.Errorf("expecting content disposition %q, got %q", expected, res.Header.Get("Content-Disposition"))
+	}
+}
+
+func TestTools_ReadNDJSON(t *testing.T) {
+	var testTools Tools
+
+	var handled []string
+	handle := func(raw json.RawMessage) error {
+		handled = append(handled, string(raw))
+		return nil
+	}
+
+	body := "{\"id\":1}\n{\"id\":2}\n\n{\"id\":3}\n"
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err := testTools.ReadNDJSON(httptest.NewRecorder(), req, handle)
+	if err != nil {
+		t.Error("not expecting any error, got: ", err)
+	}
+
+	if strings.Join(handled, ",") != `{"id":1},{"id":2},{"id":3}` {
+		t.Errorf("expecting three handled values, got %v", handled)
+	}
+
+	handled = nil
+	body = "{\"id\":1}\n{\"id\":\n{\"id\":3}\n"
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.ReadNDJSON(httptest.NewRecorder(), req, handle)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expecting an error for line 2, got %v", err)
+	}
+
+	if len(handled) != 1 {
+		t.Errorf("expecting processing to stop at the malformed line, handled %d values", len(handled))
+	}
+
+	stop := errors.New("stop")
+	req = httptest.NewRequest("POST", "/", strings.NewReader("{\"id\":1}\n{\"id\":2}\n"))
+	err = testTools.ReadNDJSON(httptest.NewRecorder(), req, func(raw json.RawMessage) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("expecting the error from handle, got %v", err)
+	}
+
+	testTools.MaxJSONSize = 10
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.ReadNDJSON(httptest.NewRecorder(), req, func(raw json.RawMessage) error { return nil })
+	if err == nil {
+		t.Error("expecting an error for a body larger than MaxJSONSize")
+	}
+}
+
+func TestTools_UploadOneFile_NoFiles(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("name", "no file here")
+	_ = writer.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+	_, err := testTools.UploadOneFile(request, t.TempDir())
+	if !errors.Is(err, ErrNoFileProvided) {
+		t.Errorf("expecting ErrNoFileProvided, got %v", err)
+	}
+}
+
+func TestTools_UploadOneFileFromField(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png", "image/jpeg"}}
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t,
+		testUploadPart{fieldName: "avatar", fileName: "img.png", content: readTestFile(t, "img.png")},
+		testUploadPart{fieldName: "banner", fileName: "pic.jpg", content: readTestFile(t, "pic.jpg")},
+	)
+
+	file, err := testTools.UploadOneFileFromField(request, uploadDir, "banner", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.NewFileName != "pic.jpg" {
+		t.Errorf("expecting the file of the banner field, got %q", file.NewFileName)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "img.png")); !os.IsNotExist(err) {
+		t.Error("expecting files of other fields to be ignored")
+	}
+
+	request = newUploadRequest(t, testUploadPart{fieldName: "avatar", fileName: "img.png", content: readTestFile(t, "img.png")})
+
+	_, err = testTools.UploadOneFileFromField(request, uploadDir, "banner")
+	if !errors.Is(err, ErrNoFileProvided) {
+		t.Errorf("expecting ErrNoFileProvided for a missing field, got %v", err)
+	}
+}
+
+func TestTools_MaxFileNameLength(t *testing.T) {
+	longName := strings.Repeat("a", 296) + ".png"
+
+	testcases := []struct {
+		name          string
+		truncate      bool
+		errorExpected bool
+	}{
+		{name: "reject", truncate: false, errorExpected: true},
+		{name: "truncate", truncate: true, errorExpected: false},
+	}
+
+	for _, tc := range testcases {
+		testTools := Tools{
+			AllowedFileTypes:      []string{"image/png"},
+			TruncateLongFileNames: tc.truncate,
+		}
+
+		request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: longName, content: readTestFile(t, "img.png")})
+
+		file, err := testTools.UploadOneFile(request, t.TempDir(), false)
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		if tc.truncate && file != nil {
+			if len(file.NewFileName) != 255 || !strings.HasSuffix(file.NewFileName, ".png") {
+				t.Errorf("%s: expecting a 255 byte name ending in .png, got %d bytes: %q", tc.name, len(file.NewFileName), file.NewFileName)
+			}
+		}
+	}
+
+	testTools := Tools{MaxFileNameLength: 6, TruncateLongFileNames: true}
+	got, _ := testTools.limitFileNameLength("éééé.png")
+	if got != "é.png" {
+		t.Errorf("expecting truncation to keep whole characters, got %q", got)
+	}
+}
+
+func TestTools_RandSource(t *testing.T) {
+	fixed := make([]byte, 256)
+	for i := range fixed {
+		fixed[i] = byte(i)
+	}
+
+	first := Tools{RandSource: bytes.NewReader(fixed)}
+	second := Tools{RandSource: bytes.NewReader(fixed)}
+
+	a, b := first.RandomString(50), second.RandomString(50)
+	if a != b {
+		t.Errorf("expecting the same output from the same source, got %q and %q", a, b)
+	}
+
+	if a[:3] != "abc" {
+		t.Errorf("expecting output derived from the injected bytes, got %q", a)
+	}
+
+	var defaultTools Tools
+	if defaultTools.RandomString(50) == defaultTools.RandomString(50) {
+		t.Error("expecting the default source to be random")
+	}
+
+	// a failing source falls back to crypto/rand, so uploads keep working
+	failing := Tools{RandSource: bytes.NewReader(fixed[:10]), AllowedFileTypes: []string{"image/png"}}
+	if s := failing.RandomString(50); len(s) != 50 || s[:10] != "abcdefghij" {
+		t.Errorf("expecting the injected bytes then random ones, got %q", s)
+	}
+	_, err := failing.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")}), t.TempDir())
+	if err != nil {
+		t.Errorf("expecting the upload to succeed with an exhausted source, got %v", err)
+	}
+}
+
+func TestTools_DownloadStaticFilePrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	original := readTestFile(t, "pic.jpg")
+	pathName := filepath.Join(dir, "pic.jpg")
+
+	err := os.WriteFile(pathName, original, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write(original)
+	_ = gz.Close()
+
+	err = os.WriteFile(pathName+".gz", compressed.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name             string
+		acceptEncoding   string
+		expectedEncoding string
+		expectedLength   int
+	}{
+		{name: "gzip capable client", acceptEncoding: "gzip, deflate", expectedEncoding: "gzip", expectedLength: compressed.Len()},
+		{name: "client refusing gzip", acceptEncoding: "gzip;q=0", expectedEncoding: "", expectedLength: len(original)},
+		{name: "plain client", acceptEncoding: "", expectedEncoding: "", expectedLength: len(original)},
+	}
+
+	var testTool Tools
+
+	for _, tc := range testcases {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+
+		testTool.DownloadStaticFilePrecompressed(rr, req, pathName, "puppy.jpg")
+
+		if rr.Header().Get("Content-Encoding") != tc.expectedEncoding {
+			t.Errorf("%s: expecting content encoding %q, got %q", tc.name, tc.expectedEncoding, rr.Header().Get("Content-Encoding"))
+		}
+
+		if rr.Header().Get("Content-Type") != "image/jpeg" {
+			t.Errorf("%s: expecting content type %q, got %q", tc.name, "image/jpeg", rr.Header().Get("Content-Type"))
+		}
+
+		if rr.Body.Len() != tc.expectedLength {
+			t.Errorf("%s: expecting %d bytes, got %d", tc.name, tc.expectedLength, rr.Body.Len())
+		}
+	}
+}
+
+func TestTools_ValidateCSVUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	testcases := []struct {
+		name          string
+		content       string
+		errorExpected bool
+	}{
+		{name: "conforming csv", content: "\ufeffName,Email,Age\nfoo,foo@example.com,30\nbar,bar@example.com,40\n", errorExpected: false},
+		{name: "missing column", content: "name,age\nfoo,30\n", errorExpected: true},
+		{name: "too many rows", content: "name,email\na,a@example.com\nb,b@example.com\nc,c@example.com\n", errorExpected: true},
+		{name: "malformed row", content: "name,email\na,a@example.com,extra\n", errorExpected: true},
+		{name: "empty file", content: "", errorExpected: true},
+	}
+
+	var testTools Tools
+
+	for i, tc := range testcases {
+		path := filepath.Join(dir, fmt.Sprintf("%d.csv", i))
+		err := os.WriteFile(path, []byte(tc.content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = testTools.ValidateCSVUpload(path, []string{"name", "email"}, 2)
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+	}
+}
+
+func TestTools_DownloadZip(t *testing.T) {
+	var testTool Tools
+
+	rr := httptest.NewRecorder()
+	err := testTool.DownloadZip(rr, "pictures.zip", map[string]string{
+		"images/img.png": "./testdata/img.png",
+		"images/pic.jpg": "./testdata/pic.jpg",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("wrong content type of %q", rr.Header().Get("Content-Type"))
+	}
+
+	if rr.Header().Get("Content-Disposition") != "attachment; filename=\"pictures.zip\"" {
+		t.Errorf("wrong content disposition of %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archive.File) != 2 {
+		t.Fatalf("expecting 2 entries, got %d", len(archive.File))
+	}
+
+	for _, entry := range archive.File {
+		f, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(content, readTestFile(t, filepath.Base(entry.Name))) {
+			t.Errorf("expecting entry %s to match the original file", entry.Name)
+		}
+	}
+
+	err = testTool.DownloadZip(httptest.NewRecorder(), "missing.zip", map[string]string{"missing": "./testdata/missing"})
+	if err == nil {
+		t.Error("expecting an error for a missing file")
+	}
+}
+
+func TestTools_UploadFiles_EmptyAllowedFileTypes(t *testing.T) {
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: readTestFile(t, "img.png")})
+
+	summary, err := testTools.UploadFilesWithSummary(request, uploadDir, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.Uploaded) != 0 || len(summary.Skipped) != 1 {
+		t.Errorf("expecting the file to be rejected when no types are allowed, got %+v", summary)
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 0 {
+		t.Errorf("expecting nothing to be written, found %d files", len(entries))
+	}
+
+	testTools.AllowedFileTypes = []string{"image/png"}
+	request = newUploadRequest(t, testUploadPart{fieldName: "file", fileName: "img.png", content: readTestFile(t, "img.png")})
+
+	_, err = testTools.UploadOneFile(request, uploadDir)
+	if err != nil {
+		t.Error("expecting an explicitly allowed type to be accepted, got: ", err)
+	}
+}
+
+func TestTools_NegotiateLanguage(t *testing.T) {
+	var testTools Tools
+	supported := []string{"en", "fr-FR", "id"}
+
+	testcases := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{name: "empty header", header: "", expected: "en"},
+		{name: "exact match", header: "id", expected: "id"},
+		{name: "weighted languages", header: "de;q=0.9, fr-FR;q=0.8, id;q=0.5", expected: "fr-FR"},
+		{name: "quality order", header: "en;q=0.1, id;q=0.7", expected: "id"},
+		{name: "primary subtag match", header: "fr-CA, en;q=0.5", expected: "fr-FR"},
+		{name: "excluded language", header: "id;q=0, fr", expected: "fr-FR"},
+		{name: "nothing supported", header: "de, ja;q=0.5", expected: "en"},
+		{name: "wildcard", header: "de, *;q=0.5", expected: "en"},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", tc.header)
+
+		if got := testTools.NegotiateLanguage(req, supported); got != tc.expected {
+			t.Errorf("%s: expecting %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestTools_SafeRedirectURL(t *testing.T) {
+	var testTools Tools
+	allowedHosts := []string{"example.com"}
+
+	testcases := []struct {
+		name          string
+		candidate     string
+		expected      string
+		errorExpected bool
+	}{
+		{name: "relative path", candidate: "/dashboard?tab=1", expected: "/dashboard?tab=1"},
+		{name: "same host absolute url", candidate: "https://example.com/account", expected: "https://example.com/account"},
+		{name: "protocol relative", candidate: "//evil.com", errorExpected: true},
+		{name: "external url", candidate: "https://evil.com", errorExpected: true},
+		{name: "lookalike host", candidate: "https://example.com.evil.com/", errorExpected: true},
+		{name: "backslash trick", candidate: "/\\evil.com", errorExpected: true},
+		{name: "javascript scheme", candidate: "javascript:alert(1)", errorExpected: true},
+		{name: "empty", candidate: "", errorExpected: true},
+	}
+
+	for _, tc := range testcases {
+		got, err := testTools.SafeRedirectURL(tc.candidate, allowedHosts)
+		if err != nil && !tc.errorExpected {
+			t.Errorf("%s: expecting no error, got error: %s", tc.name, err)
+		}
+
+		if err == nil && tc.errorExpected {
+			t.Errorf("%s: expecting error, got no error", tc.name)
+		}
+
+		if got != tc.expected {
+			t.Errorf("%s: expecting %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestTools_CheckIdempotency(t *testing.T) {
+	var testTools Tools
+	store := NewMemoryIdempotencyStore()
+
+	req := httptest.NewRequest("POST", "/orders", nil)
+	req.Header.Set("Idempotency-Key", "abc123")
+
+	cached, key, err := testTools.CheckIdempotency(req, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cached != nil {
+		t.Error("expecting no cached response for a first time request")
+	}
+
+	if key != "abc123" {
+		t.Errorf("expecting key %q, got %q", "abc123", key)
+	}
+
+	err = store.Save(key, &JSONResponse{Message: "order created"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, _, err = testTools.CheckIdempotency(req, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cached == nil || cached.Message != "order created" {
+		t.Errorf("expecting the recorded response for a replayed request, got %+v", cached)
+	}
+
+	_, _, err = testTools.CheckIdempotency(httptest.NewRequest("POST", "/orders", nil), store)
+	if !errors.Is(err, ErrMissingIdempotencyKey) {
+		t.Errorf("expecting ErrMissingIdempotencyKey, got %v", err)
+	}
+
+	_, _, err = testTools.CheckIdempotency(httptest.NewRequest("GET", "/orders", nil), store)
+	if err != nil {
+		t.Error("expecting safe methods not to require a key, got: ", err)
+	}
+}
+
+type fakeMetrics struct {
+	bytes     map[string]int64
+	durations map[string]int
+	errors    map[string]int
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{bytes: map[string]int64{}, durations: map[string]int{}, errors: map[string]int{}}
+}
+
+func (m *fakeMetrics) ObserveBytes(op string, n int64)            { m.bytes[op] += n }
+func (m *fakeMetrics) ObserveDuration(op string, d time.Duration) { m.durations[op]++ }
+func (m *fakeMetrics) IncErrors(op string)                        { m.errors[op]++ }
+
+func TestTools_Metrics(t *testing.T) {
+	metrics := newFakeMetrics()
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, Metrics: metrics}
+
+	req := newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")})
+
+	files, err := testTools.UploadFiles(req, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.durations[MetricUpload] != 1 {
+		t.Errorf("expecting one upload duration observation, got %d", metrics.durations[MetricUpload])
+	}
+
+	if metrics.bytes[MetricUpload] != files[0].FileSize {
+		t.Errorf("expecting %d upload bytes observed, got %d", files[0].FileSize, metrics.bytes[MetricUpload])
+	}
+
+	if metrics.errors[MetricUpload] != 0 {
+		t.Errorf("expecting no upload error, got %d", metrics.errors[MetricUpload])
+	}
+
+	var data struct{}
+	_ = testTools.ReadJSON(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("{")), &data)
+	if metrics.errors[MetricReadJSON] != 1 || metrics.bytes[MetricReadJSON] != 1 {
+		t.Errorf("expecting a failed read of 1 byte, got %d errors and %d bytes", metrics.errors[MetricReadJSON], metrics.bytes[MetricReadJSON])
+	}
+}
+
+func TestTools_UploadFilesMaxFileSize(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	size := int64(len(content))
+
+	tests := []struct {
+		name          string
+		maxFileSize   int64
+		errorExpected bool
+	}{
+		{name: "under the limit", maxFileSize: size + 1},
+		{name: "at the limit", maxFileSize: size},
+		{name: "over the limit", maxFileSize: size - 1, errorExpected: true},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxFileSize: e.maxFileSize}
+		uploadDir := t.TempDir()
+
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+
+		_, err := testTools.UploadFiles(req, uploadDir, false)
+		if e.errorExpected {
+			if !errors.Is(err, ErrFileTooBig) {
+				t.Errorf("%s: expecting ErrFileTooBig, got %v", e.name, err)
+			} else if !strings.Contains(err.Error(), "img.png") {
+				t.Errorf("%s: expecting the error to name the file, got %v", e.name, err)
+			}
+
+			if _, statErr := os.Stat(filepath.Join(uploadDir, "img.png")); !os.IsNotExist(statErr) {
+				t.Errorf("%s: expecting no file to be written", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesMaxUploadCount(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name          string
+		files         int
+		errorExpected bool
+	}{
+		{name: "under the limit", files: 1},
+		{name: "at the limit", files: 2},
+		{name: "over the limit", files: 3, errorExpected: true},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxUploadCount: 2}
+		uploadDir := t.TempDir()
+
+		var parts []testUploadPart
+		for i := 0; i < e.files; i++ {
+			parts = append(parts, testUploadPart{"file", fmt.Sprintf("img%d.png", i), content})
+		}
+
+		files, err := testTools.UploadFiles(newUploadRequest(t, parts...), uploadDir)
+		if e.errorExpected {
+			if !errors.Is(err, ErrTooManyFiles) {
+				t.Errorf("%s: expecting ErrTooManyFiles, got %v", e.name, err)
+			}
+
+			entries, _ := os.ReadDir(uploadDir)
+			if len(entries) != 0 {
+				t.Errorf("%s: expecting nothing written, got %d files", e.name, len(entries))
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		}
+
+		if len(files) != e.files {
+			t.Errorf("%s: expecting %d files, got %d", e.name, e.files, len(files))
+		}
+	}
+}
+
+func TestTools_MatchContentType(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		contentType string
+		matched     bool
+	}{
+		{"image/png", "image/png", true},
+		{"IMAGE/PNG", "image/png", true},
+		{"image/png", "image/jpeg", false},
+		{"text/plain; charset=utf-8", "text/plain; charset=utf-8", true},
+		{"text/plain", "text/plain; charset=utf-8", false},
+		{"image/*", "image/png", true},
+		{"Image/*", "image/jpeg", true},
+		{"image/*", "application/pdf", false},
+		{"text/*", "text/plain; charset=utf-8", true},
+		{"application/*+json", "application/ld+json", true},
+		{"application/*+json", "application/json", false},
+		{"*", "image/png", false},
+		{"*/*", "image/png", false},
+		{"*/png", "image/png", false},
+	}
+
+	for _, e := range tests {
+		if matched := matchContentType(e.pattern, e.contentType); matched != e.matched {
+			t.Errorf("%q against %q: expecting %v, got %v", e.pattern, e.contentType, e.matched, matched)
+		}
+	}
+}
+
+func TestTools_UploadFilesWildcardTypes(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"application/pdf", "image/*"}}
+
+	req := newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")})
+
+	_, err := testTools.UploadFiles(req, t.TempDir())
+	if err != nil {
+		t.Error("expecting image/* to allow a png, got: ", err)
+	}
+}
+
+func TestTools_UploadFilesRequireExtensionMatch(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name          string
+		fileName      string
+		extraTypes    map[string]string
+		errorExpected bool
+	}{
+		{name: "matching", fileName: "img.png"},
+		{name: "matching upper case", fileName: "IMG.PNG"},
+		{name: "mismatched", fileName: "img.jpg", errorExpected: true},
+		{name: "no extension", fileName: "img", errorExpected: true},
+		{name: "unknown extension", fileName: "img.apng", errorExpected: true},
+		{name: "registered extension", fileName: "img.apng", extraTypes: map[string]string{".apng": "image/png"}},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{
+			AllowedFileTypes:      []string{"image/png"},
+			RequireExtensionMatch: true,
+			ExtensionContentTypes: e.extraTypes,
+		}
+
+		req := newUploadRequest(t, testUploadPart{"file", e.fileName, content})
+
+		_, err := testTools.UploadFiles(req, t.TempDir())
+		if e.errorExpected {
+			if !errors.Is(err, ErrExtensionMismatch) {
+				t.Errorf("%s: expecting ErrExtensionMismatch, got %v", e.name, err)
+			} else if !strings.Contains(err.Error(), "image/png") {
+				t.Errorf("%s: expecting the error to name the detected type, got %v", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesAllowedFileExtensions(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name         string
+		fileName     string
+		allowedTypes []string
+		allowedExts  []string
+		expectedErr  error
+	}{
+		{name: "extension only", fileName: "img.png", allowedExts: []string{".png"}},
+		{name: "without dot", fileName: "img.PNG", allowedExts: []string{"png"}},
+		{name: "both pass", fileName: "img.png", allowedTypes: []string{"image/png"}, allowedExts: []string{".png"}},
+		{name: "extension fails", fileName: "img.gif", allowedTypes: []string{"image/png"}, allowedExts: []string{".png"}, expectedErr: ErrFileExtensionNotPermitted},
+		{name: "type fails", fileName: "img.png", allowedTypes: []string{"image/jpeg"}, allowedExts: []string{".png"}, expectedErr: ErrFileTypeNotPermitted},
+		{name: "no extension", fileName: "img", allowedExts: []string{".png"}, expectedErr: ErrFileExtensionNotPermitted},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: e.allowedTypes, AllowedFileExtensions: e.allowedExts}
+
+		req := newUploadRequest(t, testUploadPart{"file", e.fileName, content})
+
+		_, err := testTools.UploadFiles(req, t.TempDir())
+		if e.expectedErr != nil {
+			if !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s: expecting %v, got %v", e.name, e.expectedErr, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesDisallowedFileTypes(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name          string
+		allowedTypes  []string
+		blockedTypes  []string
+		errorExpected bool
+	}{
+		{name: "blocked only", blockedTypes: []string{"image/png"}, errorExpected: true},
+		{name: "other type blocked", blockedTypes: []string{"application/zip"}},
+		{name: "in both lists", allowedTypes: []string{"image/png"}, blockedTypes: []string{"image/png"}, errorExpected: true},
+		{name: "wildcard block over exact allow", allowedTypes: []string{"image/png"}, blockedTypes: []string{"image/*"}, errorExpected: true},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: e.allowedTypes, DisallowedFileTypes: e.blockedTypes}
+
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+
+		_, err := testTools.UploadFiles(req, t.TempDir())
+		if e.errorExpected {
+			var blocked *BlockedFileTypeError
+			if !errors.As(err, &blocked) {
+				t.Errorf("%s: expecting a BlockedFileTypeError, got %v", e.name, err)
+			} else if blocked.ContentType != "image/png" {
+				t.Errorf("%s: expecting the blocked type to be image/png, got %s", e.name, blocked.ContentType)
+			}
+
+			if !errors.Is(err, ErrFileTypeNotPermitted) {
+				t.Errorf("%s: expecting the error to match ErrFileTypeNotPermitted", e.name)
+			}
+
+			if strings.Count(err.Error(), "img.png") != 1 {
+				t.Errorf("%s: expecting the file name once in the error, got %q", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesFieldName(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+	content := readTestFile(t, "img.png")
+
+	req := newUploadRequest(t,
+		testUploadPart{"avatar", "avatar.png", content},
+		testUploadPart{"attachments", "attachment.png", content},
+	)
+
+	files, err := testTools.UploadFiles(req, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string]string)
+	for _, f := range files {
+		fields[f.OriginalFileName] = f.FieldName
+	}
+
+	if fields["avatar.png"] != "avatar" || fields["attachment.png"] != "attachments" {
+		t.Errorf("expecting each file to record its field, got %v", fields)
+	}
+}
+
+func TestTools_UploadFilesRenameFunc(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name         string
+		renameFunc   func(string) string
+		expectedName string
+	}{
+		{name: "custom", renameFunc: func(name string) string { return "42-" + name }, expectedName: "42-img.png"},
+		{name: "separators", renameFunc: func(name string) string { return "../" + name }, expectedName: ".._img.png"},
+		{name: "fallback", renameFunc: func(name string) string { return "" }},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, RenameFunc: e.renameFunc}
+
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+
+		files, err := testTools.UploadFiles(req, t.TempDir())
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if e.expectedName != "" {
+			if files[0].NewFileName != e.expectedName {
+				t.Errorf("%s: expecting %q, got %q", e.name, e.expectedName, files[0].NewFileName)
+			}
+			continue
+		}
+
+		if len(files[0].NewFileName) != 25+len(".png") {
+			t.Errorf("%s: expecting a random name, got %q", e.name, files[0].NewFileName)
+		}
+	}
+}
+
+func TestTools_UploadFilesRenameSlug(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name     string
+		fileName string
+		pattern  string
+	}{
+		{name: "ascii", fileName: "Quarterly Report.PNG", pattern: `^quarterly-report-[a-z0-9]{6}\.png$`},
+		{name: "accented", fileName: "Résumé 2024.png", pattern: `^r-sum-2024-[a-z0-9]{6}\.png$`},
+		{name: "unicode only", fileName: "报告.png", pattern: `^[a-zA-Z0-9]{25}\.png$`},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, RenameStrategy: RenameSlug}
+
+		req := newUploadRequest(t, testUploadPart{"file", e.fileName, content})
+
+		files, err := testTools.UploadFiles(req, t.TempDir())
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if !regexp.MustCompile(e.pattern).MatchString(files[0].NewFileName) {
+			t.Errorf("%s: expecting a name matching %s, got %q", e.name, e.pattern, files[0].NewFileName)
+		}
+	}
+}
+
+func TestTools_UploadFilesSanitizeFileName(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name         string
+		fileName     string
+		expectedName string
+		expectedErr  error
+	}{
+		{name: "traversal", fileName: "../../etc/cron.d/evil.png", expectedName: "evil.png"},
+		{name: "windows traversal", fileName: `..\..\evil.png`, expectedName: "evil.png"},
+		{name: "invalid characters", fileName: "what?  a <name>.png", expectedName: "what a name.png"},
+		{name: "nothing usable", fileName: "../..", expectedErr: ErrInvalidFileName},
+		{name: "too long", fileName: strings.Repeat("a", 300) + ".png", expectedErr: ErrFileNameTooLong},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+		uploadDir := t.TempDir()
+
+		req := newUploadRequest(t, testUploadPart{"file", e.fileName, content})
+
+		files, err := testTools.UploadFiles(req, uploadDir, false)
+		if e.expectedErr != nil {
+			if !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s: expecting %v, got %v", e.name, e.expectedErr, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		if files[0].NewFileName != e.expectedName {
+			t.Errorf("%s: expecting %q, got %q", e.name, e.expectedName, files[0].NewFileName)
+		}
+
+		if filepath.Dir(files[0].FullPath) != uploadDir {
+			t.Errorf("%s: expecting the file to be written in the upload directory, got %q", e.name, files[0].FullPath)
+		}
+	}
+
+	// the multipart writer can't send a NUL byte, so the sanitizer is called directly
+	name, err := sanitizeFileName("evil\x00.png")
+	if err != nil || name != "evil.png" {
+		t.Errorf("nul byte: expecting %q, got %q and %v", "evil.png", name, err)
+	}
+}
+
+func TestTools_UploadFilesNoFile(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+	newRequest := func() *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("title", "no file here")
+		_ = writer.Close()
+
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req
+	}
+
+	_, err := testTools.UploadFiles(newRequest(), t.TempDir())
+	if !errors.Is(err, ErrNoFileProvided) {
+		t.Errorf("UploadFiles: expecting ErrNoFileProvided, got %v", err)
+	}
+
+	_, err = testTools.UploadOneFile(newRequest(), t.TempDir())
+	if !errors.Is(err, ErrNoFileProvided) {
+		t.Errorf("UploadOneFile: expecting ErrNoFileProvided, got %v", err)
+	}
+}
+
+func TestTools_UploadFieldName(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadFieldName: "document"}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newUploadRequest(t,
+		testUploadPart{"document", "document.png", content},
+		testUploadPart{"other", "other.png", content},
+	), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].OriginalFileName != "document.png" {
+		t.Errorf("expecting only document.png to be saved, got %d files", len(files))
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "other.png")); !os.IsNotExist(err) {
+		t.Error("expecting other.png not to be written")
+	}
+
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"other", "other.png", content}), t.TempDir())
+	if !errors.Is(err, ErrNoFileProvided) {
+		t.Errorf("expecting ErrNoFileProvided when the field is missing, got %v", err)
+	}
+
+	testTools.RejectUnexpectedUploadFields = true
+	_, err = testTools.UploadFiles(newUploadRequest(t,
+		testUploadPart{"document", "document.png", content},
+		testUploadPart{"other", "other.png", content},
+	), t.TempDir())
+	if !errors.Is(err, ErrUnexpectedUploadField) {
+		t.Errorf("expecting ErrUnexpectedUploadField, got %v", err)
+	}
+}
+
+// cancelingReader calls cancel once more than after bytes have been read from r
+type cancelingReader struct {
+	r      io.Reader
+	after  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	if c.read > c.after {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestTools_UploadFilesWithContext(t *testing.T) {
+	content := readTestFile(t, "pic.jpg")
+
+	for _, concurrency := range []int{1, 2} {
+		testTools := Tools{AllowedFileTypes: []string{"image/jpeg"}, UploadConcurrency: concurrency}
+		uploadDir := t.TempDir()
+
+		req := newUploadRequest(t,
+			testUploadPart{"file", "first.jpg", content},
+			testUploadPart{"file", "second.jpg", content},
+		)
+
+		// the client goes away halfway through the second file, once the first one is saved
+		ctx, cancel := context.WithCancel(context.Background())
+		req.Body = io.NopCloser(&cancelingReader{r: req.Body, after: len(content) + len(content)/2, cancel: cancel})
+
+		_, err := testTools.UploadFilesWithContext(ctx, req, uploadDir, false)
+		cancel()
+
+		var canceledErr *UploadCanceledError
+		if !errors.As(err, &canceledErr) || !errors.Is(err, context.Canceled) {
+			t.Errorf("concurrency %d: expecting an UploadCanceledError wrapping context.Canceled, got %v", concurrency, err)
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if len(entries) != 0 {
+			t.Errorf("concurrency %d: expecting the saved and partial files to be removed, got %d files", concurrency, len(entries))
+		}
+	}
+}
+
+func TestTools_UploadFilesKeepsFormValues(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("title", "holiday")
+	part, _ := writer.CreateFormFile("file", "img.png")
+	_, _ = part.Write(readTestFile(t, "img.png"))
+	_ = writer.Close()
+
+	req := httptest.NewRequest("POST", "/?page=2", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	_, err := testTools.UploadFiles(req, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.FormValue("title") != "holiday" || req.PostFormValue("title") != "holiday" {
+		t.Errorf("expecting the text field to be readable after the upload, got %q", req.FormValue("title"))
+	}
+
+	if req.FormValue("page") != "2" {
+		t.Errorf("expecting the query to be readable after the upload, got %q", req.FormValue("page"))
+	}
+}
+
+// BenchmarkTools_UploadFiles compares streaming the multipart body, what UploadFiles does,
+// with saving the files of a form parsed beforehand by ParseMultipartForm
+func BenchmarkTools_UploadFiles(b *testing.B) {
+	// a png signature is enough for the content to be sniffed as image/png
+	content := make([]byte, 50<<20)
+	copy(content, "\x89PNG\x0D\x0A\x1A\x0A")
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "big.png")
+	_, _ = part.Write(content)
+	_ = writer.Close()
+	payload := body.Bytes()
+
+	for _, parseFirst := range []bool{false, true} {
+		name := "stream"
+		if parseFirst {
+			name = "parsed-form"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxFileSize: 64 << 20}
+			uploadDir := b.TempDir()
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/", bytes.NewReader(payload))
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+
+				if parseFirst {
+					// a low memory threshold, like MaxFileSize usually is, sends the file to a temp file
+					if err := req.ParseMultipartForm(1 << 20); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				files, err := testTools.UploadFiles(req, uploadDir)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				_ = os.Remove(files[0].FullPath)
+				if req.MultipartForm != nil {
+					_ = req.MultipartForm.RemoveAll()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTools_CopyBuffer(b *testing.B) {
+	content := make([]byte, 8<<20)
+	dir := b.TempDir()
+
+	copiers := map[string]func(dst io.Writer, src io.Reader) (int64, error){
+		"io.Copy": io.Copy,
+		"pooled": func(dst io.Writer, src io.Reader) (int64, error) {
+			return copyUpload(dst, src, 0)
+		},
+	}
+
+	for _, name := range []string{"io.Copy", "pooled"} {
+		copier := copiers[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(content)))
+
+			for i := 0; i < b.N; i++ {
+				f, err := os.Create(filepath.Join(dir, "copy"))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// an upload body doesn't implement io.WriterTo
+				_, err = copier(f, struct{ io.Reader }{bytes.NewReader(content)})
+				_ = f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTools_CopyBufferSize(t *testing.T) {
+	content := readTestFile(t, "pic.jpg")
+
+	for _, size := range []int{0, 1000, 1 << 20} {
+		var out bytes.Buffer
+		n, err := copyUpload(&out, bytes.NewReader(content), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+			t.Errorf("buffer size %d: expecting an identical copy, got %d bytes", size, n)
+		}
+	}
+}
+
+func BenchmarkTools_UploadConcurrency(b *testing.B) {
+	// a png signature is enough for the content to be sniffed as image/png
+	content := make([]byte, 8<<20)
+	copy(content, "\x89PNG\x0D\x0A\x1A\x0A")
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i := 0; i < 8; i++ {
+		part, _ := writer.CreateFormFile("file", fmt.Sprintf("big%d.png", i))
+		_, _ = part.Write(content)
+	}
+	_ = writer.Close()
+	payload := body.Bytes()
+
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxFileSize: 16 << 20, UploadConcurrency: concurrency}
+			uploadDir := b.TempDir()
+
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/", bytes.NewReader(payload))
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				// the form is parsed up front in both cases, so only saving the files is compared
+				if err := req.ParseMultipartForm(1 << 20); err != nil {
+					b.Fatal(err)
+				}
+
+				files, err := testTools.UploadFiles(req, uploadDir)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				for _, f := range files {
+					_ = os.Remove(f.FullPath)
+				}
+				_ = req.MultipartForm.RemoveAll()
+			}
+		})
+	}
+}
+
+func TestTools_UploadFilesContinueOnUploadError(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, ContinueOnUploadError: true}
+	uploadDir := t.TempDir()
+
+	req := newUploadRequest(t,
+		testUploadPart{"file", "pic.jpg", readTestFile(t, "pic.jpg")},
+		testUploadPart{"file", "img.png", readTestFile(t, "img.png")},
+	)
+
+	files, err := testTools.UploadFiles(req, uploadDir, false)
+
+	var uploadErrs UploadErrors
+	if !errors.As(err, &uploadErrs) {
+		t.Fatalf("expecting UploadErrors, got %v", err)
+	}
+
+	if len(uploadErrs) != 1 || uploadErrs[0].FileName != "pic.jpg" || !strings.Contains(err.Error(), "pic.jpg") {
+		t.Errorf("expecting the error to name pic.jpg, got %v", err)
+	}
+
+	if len(files) != 1 || files[0].OriginalFileName != "img.png" {
+		t.Fatalf("expecting img.png to be returned, got %d files", len(files))
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "img.png")); err != nil {
+		t.Error("expecting img.png to be on disk, got: ", err)
+	}
+}
+
+func TestTools_UploadFilesUploadError(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	// a regular file used as the upload directory makes writing fail
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		tools          *Tools
+		uploadDir      string
+		expectedReason UploadErrorReason
+	}{
+		{name: "type", tools: &Tools{AllowedFileTypes: []string{"image/jpeg"}}, uploadDir: t.TempDir(), expectedReason: UploadErrorTypeNotPermitted},
+		{name: "size", tools: &Tools{AllowedFileTypes: []string{"image/png"}, MaxFileSize: 10}, uploadDir: t.TempDir(), expectedReason: UploadErrorTooLarge},
+		{name: "io", tools: &Tools{AllowedFileTypes: []string{"image/png"}}, uploadDir: notADir, expectedReason: UploadErrorIOFailure},
+	}
+
+	for _, e := range tests {
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+
+		_, err := e.tools.UploadFiles(req, e.uploadDir)
+
+		var uploadErr *UploadError
+		if !errors.As(err, &uploadErr) {
+			t.Errorf("%s: expecting an UploadError, got %v", e.name, err)
+			continue
+		}
+
+		if uploadErr.FileName != "img.png" {
+			t.Errorf("%s: expecting the file name img.png, got %q", e.name, uploadErr.FileName)
+		}
+
+		if uploadErr.Reason != e.expectedReason {
+			t.Errorf("%s: expecting reason %d, got %d: %v", e.name, e.expectedReason, uploadErr.Reason, err)
+		}
+	}
+}
+
+// failingReader returns err once r is exhausted
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestTools_UploadFilesAtomicWrite(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/jpeg"}}
+	uploadDir := t.TempDir()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "pic.jpg")
+	_, _ = part.Write(readTestFile(t, "pic.jpg"))
+	_ = writer.Close()
+
+	// the connection breaks halfway through the file
+	half := bytes.NewReader(body.Bytes()[:body.Len()/2])
+	req := httptest.NewRequest("POST", "/", &failingReader{r: half, err: errors.New("connection reset")})
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	_, err := testTools.UploadFiles(req, uploadDir, false)
+	if err == nil {
+		t.Fatal("expecting an error for a broken upload")
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	for _, entry := range entries {
+		t.Errorf("expecting no file to be left, found %s", entry.Name())
+	}
+}
+
+func TestTools_UploadFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on windows")
+	}
+
+	for _, rename := range []bool{true, false} {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadFileMode: 0600}
+
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")})
+
+		files, err := testTools.UploadFiles(req, t.TempDir(), rename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat(files[0].FullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("rename %v: expecting mode 0600, got %o", rename, info.Mode().Perm())
+		}
+	}
+}
+
+func TestTools_CollisionPolicy(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	tests := []struct {
+		name          string
+		policy        CollisionPolicy
+		expectedName  string
+		errorExpected bool
+	}{
+		{name: "overwrite", policy: CollisionOverwrite, expectedName: "img.png"},
+		{name: "error", policy: CollisionError, errorExpected: true},
+		{name: "suffix", policy: CollisionAutoSuffix, expectedName: "img-1.png"},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, CollisionPolicy: e.policy}
+		uploadDir := t.TempDir()
+
+		existing := filepath.Join(uploadDir, "img.png")
+		if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+
+		files, err := testTools.UploadFiles(req, uploadDir, false)
+		if e.errorExpected {
+			if !errors.Is(err, ErrFileExists) {
+				t.Errorf("%s: expecting ErrFileExists, got %v", e.name, err)
+			}
+
+			if data, _ := os.ReadFile(existing); string(data) != "existing" {
+				t.Errorf("%s: expecting the existing file to be untouched", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		if files[0].NewFileName != e.expectedName {
+			t.Errorf("%s: expecting %q, got %q", e.name, e.expectedName, files[0].NewFileName)
+		}
+	}
+
+	// the policy also applies to the files of one request
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, CollisionPolicy: CollisionAutoSuffix}
+	req := newUploadRequest(t, testUploadPart{"file", "img.png", content}, testUploadPart{"file", "img.png", content})
+
+	files, err := testTools.UploadFiles(req, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files[0].NewFileName != "img.png" || files[1].NewFileName != "img-1.png" {
+		t.Errorf("expecting img.png and img-1.png, got %d files", len(files))
+	}
+}
+
+func TestTools_UploadPathLayout(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadPathLayout: "2006/01/02", PublicBaseURL: "https://cdn.example.com/uploads"}
+	uploadDir := t.TempDir()
+
+	req := newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")})
+
+	files, err := testTools.UploadFiles(req, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Now().Format("2006/01/02")
+	expected := filepath.Join(filepath.FromSlash(day), "img.png")
+
+	if files[0].RelativePath != expected {
+		t.Errorf("expecting the relative path %q, got %q", expected, files[0].RelativePath)
+	}
+
+	if files[0].FullPath != filepath.Join(uploadDir, expected) {
+		t.Errorf("expecting the full path to include the layout, got %q", files[0].FullPath)
+	}
+
+	if _, err := os.Stat(files[0].FullPath); err != nil {
+		t.Error("expecting the file to exist, got: ", err)
+	}
+
+	if files[0].URL != "https://cdn.example.com/uploads/"+day+"/img.png" {
+		t.Errorf("expecting the URL to include the layout, got %q", files[0].URL)
+	}
+}
+
+func TestTools_ShardUploads(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	for _, rename := range []bool{true, false} {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, ShardUploads: 2}
+		uploadDir := t.TempDir()
+
+		req := newUploadRequest(t, testUploadPart{"file", "My Photo.png", content})
+
+		files, err := testTools.UploadFiles(req, uploadDir, rename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256([]byte(files[0].NewFileName))
+		digest := hex.EncodeToString(sum[:])
+		expected := filepath.Join(digest[0:2], digest[2:4], files[0].NewFileName)
+
+		if files[0].RelativePath != expected {
+			t.Errorf("rename %v: expecting the relative path %q, got %q", rename, expected, files[0].RelativePath)
+		}
+
+		data, err := os.ReadFile(filepath.Join(uploadDir, files[0].RelativePath))
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("rename %v: expecting the file to be retrievable at the reported path, got %v", rename, err)
+		}
+	}
+}
+
+func TestTools_OnUploadProgress(t *testing.T) {
+	content := readTestFile(t, "pic.jpg")
+
+	type progress struct {
+		fileName      string
+		copied, total int64
+	}
+
+	var calls []progress
+	testTools := Tools{
+		AllowedFileTypes: []string{"image/jpeg"},
+		OnUploadProgress: func(fileName string, copied, total int64) {
+			calls = append(calls, progress{fileName, copied, total})
+			panic("the callback must not break the upload")
+		},
+	}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "pic.jpg", content}), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) == 0 {
+		t.Fatal("expecting the callback to be called")
+	}
+
+	last := calls[len(calls)-1]
+	if last.fileName != "pic.jpg" || last.copied != int64(len(content)) || last.copied != files[0].FileSize {
+		t.Errorf("expecting a final call with %d bytes, got %+v", len(content), last)
+	}
+
+	if last.total != -1 {
+		t.Errorf("expecting an unknown total when streaming, got %d", last.total)
+	}
+
+	// the size of a parsed form file is known
+	calls = nil
+	req := newUploadRequest(t, testUploadPart{"file", "pic.jpg", content})
+	_, err = testTools.UploadFilesWithSummary(req, t.TempDir(), UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) == 0 || calls[len(calls)-1].total != int64(len(content)) {
+		t.Errorf("expecting the total to be the file size, got %+v", calls)
+	}
+}
+
+func TestTools_MaxTotalUploadSize(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	size := int64(len(content))
+
+	// the second file goes over the limit halfway through, and the thumbnail of the first
+	// is removed along with it
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxTotalUploadSize: size + size/2, Thumbnail: &ThumbnailSpec{Width: 100, Height: 100}}
+	uploadDir := t.TempDir()
+
+	req := newUploadRequest(t,
+		testUploadPart{"file", "first.png", content},
+		testUploadPart{"file", "second.png", content},
+	)
+
+	_, err := testTools.UploadFiles(req, uploadDir, false)
+
+	var totalErr *TotalSizeExceededError
+	if !errors.As(err, &totalErr) || !errors.Is(err, ErrTotalSizeExceeded) {
+		t.Fatalf("expecting a TotalSizeExceededError, got %v", err)
+	}
+
+	if totalErr.Accepted != size {
+		t.Errorf("expecting %d bytes accepted, got %d", size, totalErr.Accepted)
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	for _, entry := range entries {
+		t.Errorf("expecting no file to be left, found %s", entry.Name())
+	}
+
+	// both files fit
+	testTools.MaxTotalUploadSize = 2 * size
+	req = newUploadRequest(t,
+		testUploadPart{"file", "first.png", content},
+		testUploadPart{"file", "second.png", content},
+	)
+
+	files, err := testTools.UploadFiles(req, t.TempDir(), false)
+	if err != nil || len(files) != 2 {
+		t.Errorf("expecting both files to be saved, got %d and %v", len(files), err)
+	}
+}
+
+func TestTools_MinFileSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     []byte
+		minFileSize int64
+		expectedErr error
+	}{
+		{name: "empty", content: nil, expectedErr: ErrFileTooSmall},
+		{name: "10 bytes", content: []byte("0123456789"), minFileSize: 1024, expectedErr: ErrFileTooSmall},
+		{name: "10 bytes without minimum", content: []byte("0123456789")},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"text/plain; charset=utf-8"}, MinFileSize: e.minFileSize}
+		uploadDir := t.TempDir()
+
+		req := newUploadRequest(t, testUploadPart{"file", "small.txt", e.content})
+
+		files, err := testTools.UploadFiles(req, uploadDir, false)
+		if e.expectedErr != nil {
+			if !errors.Is(err, e.expectedErr) {
+				t.Errorf("%s: expecting %v, got %v", e.name, e.expectedErr, err)
+			}
+
+			entries, _ := os.ReadDir(uploadDir)
+			for _, entry := range entries {
+				t.Errorf("%s: expecting no file to be left, found %s", e.name, entry.Name())
+			}
+			continue
+		}
+
+		// a file smaller than the sniffed sample is still detected as text
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		} else if files[0].FileSize != int64(len(e.content)) {
+			t.Errorf("%s: expecting %d bytes, got %d", e.name, len(e.content), files[0].FileSize)
+		}
+	}
+}
+
+func TestTools_MaxImageDimensions(t *testing.T) {
+	// img.png is 640x426
+	tests := []struct {
+		name          string
+		fileName      string
+		maxWidth      int
+		maxHeight     int
+		errorExpected bool
+	}{
+		{name: "under", fileName: "img.png", maxWidth: 4096, maxHeight: 4096},
+		{name: "at", fileName: "img.png", maxWidth: 640, maxHeight: 426},
+		{name: "too wide", fileName: "img.png", maxWidth: 600, errorExpected: true},
+		{name: "too high", fileName: "img.png", maxHeight: 400, errorExpected: true},
+		{name: "not an image", fileName: "notes.txt", maxWidth: 1, maxHeight: 1},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{
+			AllowedFileTypes: []string{"image/png", "text/plain; charset=utf-8"},
+			MaxImageWidth:    e.maxWidth,
+			MaxImageHeight:   e.maxHeight,
+		}
+
+		content := []byte("just some notes")
+		if e.fileName == "img.png" {
+			content = readTestFile(t, "img.png")
+		}
+
+		req := newUploadRequest(t, testUploadPart{"file", e.fileName, content})
+
+		files, err := testTools.UploadFiles(req, t.TempDir())
+		if e.errorExpected {
+			if !errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("%s: expecting ErrImageTooLarge, got %v", e.name, err)
+			} else if !strings.Contains(err.Error(), "640x426") {
+				t.Errorf("%s: expecting the error to include the dimensions, got %v", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+		} else if files[0].FileSize != int64(len(content)) {
+			t.Errorf("%s: expecting the whole file to be written, got %d bytes", e.name, files[0].FileSize)
+		}
+	}
+}
+
+func TestTools_Thumbnail(t *testing.T) {
+	testTools := Tools{
+		AllowedFileTypes: []string{"image/png", "text/plain; charset=utf-8"},
+		Thumbnail:        &ThumbnailSpec{Width: 100, Height: 100},
+	}
+	uploadDir := t.TempDir()
+
+	req := newUploadRequest(t,
+		testUploadPart{"file", "img.png", readTestFile(t, "img.png")},
+		testUploadPart{"file", "notes.txt", []byte("not an image")},
+	)
+
+	files, err := testTools.UploadFiles(req, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		if file.OriginalFileName == "notes.txt" {
+			if file.ThumbnailFileName != "" {
+				t.Errorf("expecting no thumbnail for a text file, got %q", file.ThumbnailFileName)
+			}
+			continue
+		}
+
+		if file.ThumbnailErr != nil {
+			t.Fatal(file.ThumbnailErr)
+		}
+
+		if file.ThumbnailFileName != "img_thumb.png" {
+			t.Errorf("expecting img_thumb.png, got %q", file.ThumbnailFileName)
+		}
+
+		f, err := os.Open(filepath.Join(uploadDir, file.ThumbnailFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 640x426 fit within 100x100
+		if config.Width != 100 || config.Height != 67 {
+			t.Errorf("expecting a 100x67 thumbnail, got %dx%d", config.Width, config.Height)
+		}
+	}
+
+	// an unsupported format fails the thumbnail but not the upload
+	testTools.Thumbnail = &ThumbnailSpec{Width: 100, Format: "bmp"}
+	req = newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")})
+
+	files, err = testTools.UploadFiles(req, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files[0].ThumbnailErr == nil || files[0].ThumbnailFileName != "" {
+		t.Error("expecting the thumbnail failure to be reported")
+	}
+}
+
+func TestTools_StripEXIF(t *testing.T) {
+	// exif.jpg is pic.jpg with an APP1 segment holding fake GPS coordinates
+	content := readTestFile(t, "exif.jpg")
+
+	testTools := Tools{AllowedFileTypes: []string{"image/jpeg", "image/png"}, StripEXIF: true}
+
+	req := newUploadRequest(t,
+		testUploadPart{"file", "exif.jpg", content},
+		testUploadPart{"file", "img.png", readTestFile(t, "img.png")},
+	)
+
+	files, err := testTools.UploadFiles(req, t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file.FullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if file.FileSize != int64(len(data)) {
+			t.Errorf("%s: expecting FileSize %d, got %d", file.OriginalFileName, len(data), file.FileSize)
+		}
+
+		if file.OriginalFileName == "img.png" {
+			if !bytes.Equal(data, readTestFile(t, "img.png")) {
+				t.Error("expecting png files to be untouched")
+			}
+			continue
+		}
+
+		if bytes.Contains(data, []byte("Exif")) || bytes.Contains(data, []byte("GPSLatitude")) {
+			t.Error("expecting the EXIF segment to be removed")
+		}
+
+		if file.FileSize >= int64(len(content)) {
+			t.Errorf("expecting the stripped file to be smaller than %d bytes, got %d", len(content), file.FileSize)
+		}
+
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			t.Error("expecting a valid JPEG, got: ", err)
+		}
+	}
+}
+
+func TestTools_ConvertImagesTo(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/*"}, ConvertImagesTo: "jpeg"}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")}), t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := files[0]
+	if file.NewFileName != "img.jpg" {
+		t.Errorf("expecting img.jpg, got %s", file.NewFileName)
+	}
+	if file.ContentType != "image/jpeg" {
+		t.Errorf("expecting image/jpeg, got %s", file.ContentType)
+	}
+
+	data, err := os.ReadFile(file.FullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.FileSize != int64(len(data)) {
+		t.Errorf("expecting FileSize %d, got %d", len(data), file.FileSize)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || config.Width != 640 || config.Height != 426 {
+		t.Errorf("expecting a 640x426 jpeg, got a %dx%d %s", config.Width, config.Height, format)
+	}
+
+	// webp is detected as an image but can't be decoded
+	webp := append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 64)...)
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.webp", webp}), t.TempDir(), false)
+
+	var convErr *ImageConversionError
+	if !errors.As(err, &convErr) {
+		t.Fatalf("expecting an ImageConversionError, got %v", err)
+	}
+	if convErr.FileName != "img.webp" {
+		t.Errorf("expecting the error to name img.webp, got %s", convErr.FileName)
+	}
+}
+
+func TestTools_MaxDecodePixels(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	// img.png is 640x426, one pixel more than allowed
+	testTools := Tools{
+		AllowedFileTypes: []string{"image/png"},
+		Thumbnail:        &ThumbnailSpec{Width: 100, Height: 100},
+		MaxDecodePixels:  640*426 - 1,
+	}
+	uploadDir := t.TempDir()
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(files[0].ThumbnailErr, ErrImageTooLarge) || files[0].ThumbnailFileName != "" {
+		t.Errorf("expecting no thumbnail for an image over MaxDecodePixels, got %q and %v", files[0].ThumbnailFileName, files[0].ThumbnailErr)
+	}
+
+	testTools.Thumbnail = nil
+	testTools.ConvertImagesTo = "jpeg"
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), t.TempDir())
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("expecting the conversion to be refused with ErrImageTooLarge, got %v", err)
+	}
+
+	testTools.MaxDecodePixels = 640 * 426
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), t.TempDir())
+	if err != nil {
+		t.Errorf("expecting an image at the limit to be converted, got %v", err)
+	}
+}
+
+func TestTools_Storage(t *testing.T) {
+	storage := &memoryStorage{files: make(map[string][]byte)}
+	content := readTestFile(t, "img.png")
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, ShardUploads: 1, Storage: storage}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.ToSlash(files[0].RelativePath)
+	if !strings.HasSuffix(name, "/img.png") {
+		t.Errorf("expecting a sharded name, got %s", name)
+	}
+	if !bytes.Equal(storage.files[name], content) {
+		t.Error("expecting the storage to receive the uploaded file")
+	}
+	if files[0].FullPath != "" {
+		t.Errorf("expecting no FullPath, got %s", files[0].FullPath)
+	}
+
+	// a file over the limit fails the storage write
+	testTools.MaxFileSize = 1024
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "big.png", content}), "", false)
+	if !errors.Is(err, ErrFileTooBig) {
+		t.Errorf("expecting ErrFileTooBig, got %v", err)
+	}
+	if _, ok := storage.files["big.png"]; ok || len(storage.files) != 1 {
+		t.Errorf("expecting the storage to keep only the first file, got %d files", len(storage.files))
+	}
+}
+
+func TestTools_UploadFilesToMemory(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+	files, err := testTools.UploadFilesToMemory(newUploadRequest(t, testUploadPart{"file", "img.png", content}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expecting 1 file, got %d", len(files))
+	}
+	file := files[0]
+	if !bytes.Equal(file.Data, content) {
+		t.Error("expecting the data to match the uploaded file")
+	}
+	if file.FileSize != int64(len(content)) || file.ContentType != "image/png" || file.OriginalFileName != "img.png" {
+		t.Errorf("unexpected file: %s %s %d", file.OriginalFileName, file.ContentType, file.FileSize)
+	}
+
+	// the files of concurrent workers are kept together
+	concurrentTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadConcurrency: 4}
+	var parts []testUploadPart
+	for i := 0; i < 8; i++ {
+		parts = append(parts, testUploadPart{"file", fmt.Sprintf("img-%d.png", i), content})
+	}
+	files, err = concurrentTools.UploadFilesToMemory(newUploadRequest(t, parts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(parts) {
+		t.Fatalf("expecting %d files, got %d", len(parts), len(files))
+	}
+	for i, f := range files {
+		if f.OriginalFileName != parts[i].fileName || !bytes.Equal(f.Data, content) {
+			t.Errorf("expecting the data of %s, got %s", parts[i].fileName, f.OriginalFileName)
+		}
+	}
+
+	testTools.MaxFileSize = 1024
+	_, err = testTools.UploadFilesToMemory(newUploadRequest(t, testUploadPart{"file", "img.png", content}))
+	if !errors.Is(err, ErrFileTooBig) {
+		t.Errorf("expecting ErrFileTooBig, got %v", err)
+	}
+}
+
+func TestTools_UploadBase64File(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	encoded := base64.StdEncoding.EncodeToString(content)
+
+	tests := []struct {
+		name        string
+		data        string
+		maxFileSize int64
+		errorIs     error
+	}{
+		{name: "plain base64", data: encoded},
+		// the declared type is ignored, the content is a png
+		{name: "data URL", data: "data:text/plain;base64," + encoded},
+		{name: "too big", data: encoded, maxFileSize: 1024, errorIs: ErrFileTooBig},
+		{name: "malformed", data: "not base64!", errorIs: ErrMalformedBase64},
+		{name: "data URL not base64", data: "data:image/png,abc", errorIs: ErrMalformedBase64},
+	}
+
+	for _, e := range tests {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxJSONSize: 10 << 20, MaxFileSize: e.maxFileSize}
+
+		body, _ := json.Marshal(Base64File{FileName: "img.png", Data: e.data})
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		uploadDir := t.TempDir()
+
+		file, err := testTools.UploadBase64File(httptest.NewRecorder(), req, uploadDir, false)
+		if e.errorIs != nil {
+			if !errors.Is(err, e.errorIs) {
+				t.Errorf("%s: expecting %v, got %v", e.name, e.errorIs, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+
+		saved, err := os.ReadFile(filepath.Join(uploadDir, file.NewFileName))
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if !bytes.Equal(saved, content) || file.ContentType != "image/png" {
+			t.Errorf("%s: expecting the png to be saved, got %d bytes of %s", e.name, len(saved), file.ContentType)
+		}
+	}
+}
+
+// magicScanner rejects files containing magic
+type magicScanner struct {
+	magic []byte
+}
+
+func (m magicScanner) Scan(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Contains(data, m.magic) {
+		return errors.New("infected")
+	}
+
+	return nil
+}
+
+func TestTools_UploadScanner(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	// the magic is near the end, far past the sniffed bytes
+	magic := content[len(content)-64 : len(content)-48]
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadScanner: magicScanner{magic: magic}}
+
+	uploadDir := t.TempDir()
+	_, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir, false)
+
+	var scanErr *ScanError
+	if !errors.As(err, &scanErr) || scanErr.FileName != "img.png" {
+		t.Fatalf("expecting a ScanError for img.png, got %v", err)
+	}
+
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) || uploadErr.Reason != UploadErrorRejectedByScanner {
+		t.Errorf("expecting UploadErrorRejectedByScanner, got %v", err)
+	}
+
+	if strings.Count(err.Error(), "img.png") != 1 {
+		t.Errorf("expecting the file name once in the error, got %q", err)
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 0 {
+		t.Errorf("expecting the rejected file not to be kept, found %d entries", len(entries))
+	}
+
+	testTools.UploadScanner = magicScanner{magic: []byte("not in the image")}
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].FileSize != int64(len(content)) {
+		t.Errorf("expecting %d bytes, got %d", len(content), files[0].FileSize)
+	}
+}
+
+func TestTools_DeduplicateUploads(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, DeduplicateUploads: true}
+	uploadDir := t.TempDir()
+
+	first, err := testTools.UploadOneFile(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Duplicate || first.Checksum == "" {
+		t.Errorf("expecting a new file with a checksum, got duplicate %v and checksum %q", first.Duplicate, first.Checksum)
+	}
+
+	second, err := testTools.UploadOneFile(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Duplicate || second.NewFileName != first.NewFileName || second.FileSize != first.FileSize {
+		t.Errorf("expecting the first file marked as duplicate, got %s (duplicate %v)", second.NewFileName, second.Duplicate)
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Name() != uploadIndexFileName {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) != 1 {
+		t.Errorf("expecting a single file, got %v", names)
+	}
+
+	// concurrent uploads of the same content keep one copy
+	var wg sync.WaitGroup
+	concurrentDir := t.TempDir()
+	for i := 0; i < 8; i++ {
+		req := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := testTools.UploadOneFile(req, concurrentDir)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, _ = os.ReadDir(concurrentDir)
+	if len(entries) != 2 {
+		t.Errorf("expecting one file and the index, got %d entries", len(entries))
+	}
+}
+
+func TestTools_DeduplicateUploadsOverwritten(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{AllowedFileTypes: []string{"image/png", "image/jpeg"}, DeduplicateUploads: true}
+	png, jpeg := readTestFile(t, "img.png"), readTestFile(t, "pic.jpg")
+
+	// the jpeg overwrites x.png, so the png isn't on disk anymore
+	for _, content := range [][]byte{png, jpeg} {
+		_, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "x.png", content}), uploadDir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "y.png", png}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].Duplicate || files[0].NewFileName != "y.png" {
+		t.Fatalf("expecting y.png to be kept, got %s marked duplicate %v", files[0].NewFileName, files[0].Duplicate)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "y.png"))
+	if err != nil || !bytes.Equal(saved, png) {
+		t.Errorf("expecting y.png to hold the png, got %v", err)
+	}
+	saved, _ = os.ReadFile(filepath.Join(uploadDir, "x.png"))
+	if !bytes.Equal(saved, jpeg) {
+		t.Error("expecting x.png to hold the jpeg")
+	}
+
+	// the jpeg is still found under x.png
+	files, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "z.png", jpeg}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !files[0].Duplicate || files[0].NewFileName != "x.png" {
+		t.Errorf("expecting z.png to be a duplicate of x.png, got %s", files[0].NewFileName)
+	}
+}
+
+func TestTools_DeduplicateUploadsNotWritten(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, DeduplicateUploads: true}
+	png := readTestFile(t, "img.png")
+
+	_, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "a.png", png}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b.png isn't in the index, a duplicate named like it must not replace it even for a moment
+	err = os.WriteFile(filepath.Join(uploadDir, "b.png"), []byte("not uploaded"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "b.png", png}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !files[0].Duplicate || files[0].NewFileName != "a.png" || files[0].FileSize != int64(len(png)) {
+		t.Errorf("expecting b.png to be a duplicate of a.png, got %s", files[0].NewFileName)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "b.png"))
+	if err != nil || string(saved) != "not uploaded" {
+		t.Errorf("expecting b.png to be left untouched, got %q, %v", saved, err)
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			t.Errorf("expecting no temporary file to be left, found %s", e.Name())
+		}
+	}
+}
+
+func TestTools_UploadConcurrency(t *testing.T) {
+	content := readTestFile(t, "img.png")
+
+	var parts []testUploadPart
+	for i := 0; i < 8; i++ {
+		parts = append(parts, testUploadPart{"file", fmt.Sprintf("img%d.png", i), content})
+	}
+	// a text file fails the type check
+	parts[5] = testUploadPart{"file", "notes.txt", []byte("plain text, not an image")}
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadConcurrency: 4, ContinueOnUploadError: true}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, parts...), uploadDir, false)
+
+	var failures UploadErrors
+	if !errors.As(err, &failures) || len(failures) != 1 || failures[0].FileName != "notes.txt" {
+		t.Fatalf("expecting notes.txt to fail, got %v", err)
+	}
+
+	if len(files) != 7 {
+		t.Fatalf("expecting 7 files, got %d", len(files))
+	}
+	for i, file := range files {
+		want := parts[i].fileName
+		if i >= 5 {
+			want = parts[i+1].fileName
+		}
+		if file.OriginalFileName != want {
+			t.Errorf("expecting %s at position %d, got %s", want, i, file.OriginalFileName)
+		}
+		if _, err := os.Stat(file.FullPath); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// without ContinueOnUploadError the files after the failing one aren't kept
+	testTools.ContinueOnUploadError = false
+	uploadDir = t.TempDir()
+	_, err = testTools.UploadFiles(newUploadRequest(t, parts...), uploadDir, false)
+	if !errors.Is(err, ErrFileTypeNotPermitted) {
+		t.Fatalf("expecting ErrFileTypeNotPermitted, got %v", err)
+	}
+	for _, part := range parts[6:] {
+		if _, err := os.Stat(filepath.Join(uploadDir, part.fileName)); err == nil {
+			t.Errorf("expecting %s not to be kept", part.fileName)
+		}
+	}
+}
+
+func TestTools_UploadConcurrencyCollisions(t *testing.T) {
+	content := bytes.Repeat([]byte("some text "), 60<<10)
+
+	var parts []testUploadPart
+	for i := 0; i < 6; i++ {
+		parts = append(parts, testUploadPart{"file", "a.txt", content})
+	}
+
+	for run := 0; run < 10; run++ {
+		testTools := Tools{
+			AllowedFileTypes:  []string{"text/plain; charset=utf-8"},
+			MaxFileSize:       int64(len(content)),
+			UploadConcurrency: 4,
+			CollisionPolicy:   CollisionAutoSuffix,
+		}
+
+		uploadDir := t.TempDir()
+		files, err := testTools.UploadFiles(newUploadRequest(t, parts...), uploadDir, false)
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+
+		names := make(map[string]bool)
+		for _, f := range files {
+			names[f.NewFileName] = true
+		}
+		for _, name := range []string{"a.txt", "a-1.txt", "a-2.txt", "a-3.txt", "a-4.txt", "a-5.txt"} {
+			if !names[name] {
+				t.Errorf("run %d: expecting %s to be saved, got %v", run, name, names)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesOrder(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	parts := []testUploadPart{
+		{"zeta", "z.png", content},
+		{"alpha", "a.png", content},
+		{"mid", "m.png", content},
+	}
+
+	for _, concurrency := range []int{1, 3} {
+		testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadConcurrency: concurrency}
+
+		for run := 0; run < 10; run++ {
+			files, err := testTools.UploadFiles(newUploadRequest(t, parts...), t.TempDir(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, file := range files {
+				if file.FieldName != parts[i].fieldName || file.OriginalFileName != parts[i].fileName {
+					t.Fatalf("concurrency %d: expecting %s at position %d, got %s", concurrency, parts[i].fileName, i, file.OriginalFileName)
+				}
+			}
+		}
+	}
+}
+
+func TestTools_MaxDirBytes(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	uploadDir := t.TempDir()
+
+	// the directory is 1 KB short of fitting the image
+	filler := make([]byte, 4096)
+	if err := os.WriteFile(filepath.Join(uploadDir, "filler"), filler, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxDirBytes: int64(len(filler)+len(content)) - 1024}
+
+	_, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir, false)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expecting ErrQuotaExceeded, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 1 {
+		t.Errorf("expecting only the filler in the directory, got %d entries", len(entries))
+	}
+
+	// with a cache the size is measured once and updated with the files saved
+	testTools.MaxDirBytes = int64(len(filler) + len(content))
+	testTools.DirSizeCacheTTL = time.Minute
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", content}), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "small.png", content[:512]}), uploadDir, false)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expecting the cached size to include the saved image, got %v", err)
+	}
+}
+
+func TestTools_UnicodeFileNames(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+
+	// the é of the first name is sent decomposed, as macOS does
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	headers := []string{
+		`form-data; name="file"; filename="re` + "\u0301" + `sume` + "\u0301" + ` – 2024.png"`,
+		`form-data; name="file"; filename="fallback.png"; filename*=UTF-8''r%C3%A9sum%C3%A9%20encoded.png`,
+		`form-data; name="file"; filename="=?UTF-8?B?w6l0w6kucG5n?="`,
+		`form-data; name="file"; filename="con.png"`,
+		// Greek and Hangul compose too
+		`form-data; name="file"; filename="` + "\u03b1\u0301 \u1112\u1161\u11ab" + `.png"`,
+	}
+	for _, h := range headers {
+		part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Disposition": {h}, "Content-Type": {"image/png"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = part.Write(content)
+	}
+	_ = writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	uploadDir := t.TempDir()
+	files, err := testTools.UploadFiles(req, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		original string
+		saved    string
+	}{
+		{"résumé – 2024.png", "résumé – 2024.png"},
+		{"résumé encoded.png", "résumé encoded.png"},
+		{"été.png", "été.png"},
+		{"con.png", "_con.png"},
+		{"\u03ac \ud55c.png", "\u03ac \ud55c.png"},
+	}
+	for i, e := range expected {
+		if files[i].OriginalFileName != e.original || files[i].NewFileName != e.saved {
+			t.Errorf("expecting %q saved as %q, got %q saved as %q", e.original, e.saved, files[i].OriginalFileName, files[i].NewFileName)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, e.saved)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the original name is decoded when the file is renamed too
+	file, err := testTools.UploadOneFile(newUploadRequest(t, testUploadPart{"file", "=?UTF-8?B?w6l0w6kucG5n?=", content}), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.OriginalFileName != "été.png" {
+		t.Errorf("expecting été.png, got %q", file.OriginalFileName)
+	}
+}
+
+func TestTools_CompressedUploads(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	plain := newUploadRequest(t, testUploadPart{"file", "img.png", content})
+	contentType := plain.Header.Get("Content-Type")
+	payload, _ := io.ReadAll(plain.Body)
+
+	compress := func(encoding string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		if encoding == "gzip" {
+			w = gzip.NewWriter(&buf)
+		} else {
+			w = zlib.NewWriter(&buf)
+		}
+		_, _ = w.Write(payload)
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		for _, parseFirst := range []bool{false, true} {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(compress(encoding)))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Content-Encoding", encoding)
+
+			testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+			uploadDir := t.TempDir()
+
+			var err error
+			if parseFirst {
+				_, err = testTools.UploadOneFileFromField(req, uploadDir, "file", false)
+			} else {
+				_, err = testTools.UploadFiles(req, uploadDir, false)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", encoding, err)
+			}
+
+			saved, err := os.ReadFile(filepath.Join(uploadDir, "img.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(saved, content) {
+				t.Errorf("%s: expecting the file to be saved identically", encoding)
+			}
+		}
+	}
+
+	// the decompressed size is what is checked
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(compress("gzip")))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "gzip")
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, MaxFileSize: 1024}
+	_, err := testTools.UploadFiles(req, t.TempDir())
+	if !errors.Is(err, ErrFileTooBig) {
+		t.Errorf("expecting ErrFileTooBig, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "br")
+	_, err = testTools.UploadFiles(req, t.TempDir())
+	var encodingErr *UnsupportedEncodingError
+	if !errors.As(err, &encodingErr) || encodingErr.Encoding != "br" || !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Errorf("expecting an UnsupportedEncodingError for br, got %v", err)
+	}
+}
+
+func TestTools_ImageDimensionsNonImage(t *testing.T) {
+	testTools := Tools{AllowedFileTypes: []string{"image/png", "text/plain; charset=utf-8"}}
+
+	// a png signature without a valid header can't be decoded, which isn't an error
+	broken := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), make([]byte, 64)...)
+
+	files, err := testTools.UploadFiles(newUploadRequest(t,
+		testUploadPart{"file", "notes.txt", []byte("plain text")},
+		testUploadPart{"file", "broken.png", broken},
+	), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		if file.ImageWidth != 0 || file.ImageHeight != 0 {
+			t.Errorf("%s: expecting no dimensions, got %dx%d", file.OriginalFileName, file.ImageWidth, file.ImageHeight)
+		}
+	}
+}
+
+func TestTools_UploadRawBody(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+	uploadDir := t.TempDir()
+
+	req := httptest.NewRequest("PUT", "/files/avatar.png", bytes.NewReader(content))
+	req.Header.Set("Content-Type", "image/png")
+
+	file, err := testTools.UploadRawBody(req, uploadDir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.OriginalFileName != "avatar.png" || file.ContentType != "image/png" {
+		t.Errorf("expecting avatar.png of type image/png, got %s of type %s", file.OriginalFileName, file.ContentType)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "avatar.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, content) {
+		t.Error("expecting the body to be saved identically")
+	}
+
+	// the declared type is ignored, the content decides
+	req = httptest.NewRequest("PUT", "/files/notes.png", strings.NewReader("plain text"))
+	req.Header.Set("Content-Type", "image/png")
+	_, err = testTools.UploadRawBody(req, uploadDir, "notes.png")
+	if !errors.Is(err, ErrFileTypeNotPermitted) {
+		t.Errorf("expecting ErrFileTypeNotPermitted, got %v", err)
+	}
+
+	testTools.MaxFileSize = 1024
+	req = httptest.NewRequest("PUT", "/files/big.png", bytes.NewReader(content))
+	_, err = testTools.UploadRawBody(req, uploadDir, "")
+	if !errors.Is(err, ErrFileTooBig) {
+		t.Errorf("expecting ErrFileTooBig, got %v", err)
+	}
+}
+
+func TestTools_UploadSession(t *testing.T) {
+	content := readTestFile(t, "img.png")
+	uploadDir := t.TempDir()
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}, UploadSessionDir: t.TempDir()}
+
+	id, err := testTools.StartUploadSession(UploadSessionMeta{FileName: "img.png", UploadDir: uploadDir, Size: int64(len(content)), KeepFileName: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third := int64(len(content) / 3)
+	chunks := []struct {
+		offset int64
+		data   []byte
+	}{
+		{0, content[:third]},
+		// the second chunk is cut short, then sent again at the same offset
+		{third, content[third : third+100]},
+		{third, content[third : 2*third]},
+		{2 * third, content[2*third:]},
+	}
+
+	for _, c := range chunks {
+		err = testTools.AppendUploadChunk(id, c.offset, bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a chunk past the end of the data is refused
+	err = testTools.AppendUploadChunk(id, int64(len(content))+10, strings.NewReader("x"))
+	var offsetErr *ChunkOffsetError
+	if !errors.As(err, &offsetErr) || offsetErr.Expected != int64(len(content)) {
+		t.Errorf("expecting a ChunkOffsetError, got %v", err)
+	}
+
+	file, err := testTools.CompleteUploadSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, content) || file.FileSize != int64(len(content)) {
+		t.Error("expecting the assembled file to match the fixture")
+	}
+
+	_, err = testTools.CompleteUploadSession(id)
+	if !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("expecting the completed session to be gone, got %v", err)
+	}
+
+	// an incomplete session is kept
+	id, _ = testTools.StartUploadSession(UploadSessionMeta{FileName: "img.png", UploadDir: uploadDir, Size: int64(len(content))})
+	_ = testTools.AppendUploadChunk(id, 0, bytes.NewReader(content[:third]))
+	_, err = testTools.CompleteUploadSession(id)
+	if !errors.Is(err, ErrUploadSessionIncomplete) {
+		t.Errorf("expecting ErrUploadSessionIncomplete, got %v", err)
+	}
+
+	// and removed once expired
+	testTools.UploadSessionTTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	err = testTools.AppendUploadChunk(id, third, bytes.NewReader(content[third:]))
+	if !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("expecting the expired session to be gone, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(testTools.UploadSessionDir)
+	if len(entries) != 0 {
+		t.Errorf("expecting no staged files left, got %d", len(entries))
+	}
+
+	_, err = testTools.CompleteUploadSession("../../etc/passwd")
+	if !errors.Is(err, ErrUploadSessionNotFound) {
+		t.Errorf("expecting an invalid id to be refused, got %v", err)
+	}
+}
+
+func TestTools_ContentTypeDetector(t *testing.T) {
+	// the magic bytes are past the 512 bytes http.DetectContentType looks at
+	content := append(make([]byte, 600), []byte("DWGMAGIC")...)
+
+	testTools := Tools{AllowedFileTypes: []string{"image/vnd.dwg"}}
+	_, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "plan.dwg", content}), t.TempDir())
+	if !errors.Is(err, ErrFileTypeNotPermitted) {
+		t.Fatalf("expecting application/octet-stream to be rejected, got %v", err)
+	}
+
+	var sniffed int
+	testTools.SniffSize = 1024
+	testTools.ContentTypeDetector = func(fileName string, head []byte) string {
+		sniffed = len(head)
+		if bytes.Contains(head, []byte("DWGMAGIC")) || strings.HasSuffix(fileName, ".dwg") {
+			return "image/vnd.dwg"
+		}
+		return ""
+	}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "plan.dwg", content}), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].ContentType != "image/vnd.dwg" || files[0].FileSize != int64(len(content)) {
+		t.Errorf("expecting %d bytes of image/vnd.dwg, got %d bytes of %s", len(content), files[0].FileSize, files[0].ContentType)
+	}
+	if sniffed != len(content) {
+		t.Errorf("expecting the detector to see the whole %d bytes file, got %d", len(content), sniffed)
+	}
+
+	// the detector can defer to http.DetectContentType
+	testTools.AllowedFileTypes = []string{"image/png"}
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "img.png", readTestFile(t, "img.png")}), t.TempDir())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTools_OnFileUploaded(t *testing.T) {
+	uploadDir := t.TempDir()
+	var seen []UploadedFile
+	testTools := Tools{
+		AllowedFileTypes:      []string{"image/png", "text/plain; charset=utf-8"},
+		ContinueOnUploadError: true,
+		DeduplicateUploads:    true,
+		OnFileUploaded: func(f *UploadedFile) error {
+			seen = append(seen, *f)
+			if f.ContentType == "text/plain; charset=utf-8" {
+				return errors.New("no row inserted")
+			}
+			return nil
+		},
+	}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t,
+		testUploadPart{"file", "img.png", readTestFile(t, "img.png")},
+		testUploadPart{"file", "notes.txt", []byte("some notes")},
+	), uploadDir)
+
+	var uploadErrs UploadErrors
+	if !errors.As(err, &uploadErrs) || len(uploadErrs) != 1 {
+		t.Fatalf("expecting one upload error, got %v", err)
+	}
+	if uploadErrs[0].FileName != "notes.txt" || uploadErrs[0].Err.Error() != "no row inserted" {
+		t.Errorf("expecting the error of the callback for notes.txt, got %v", uploadErrs[0])
+	}
+
+	if len(seen) != 2 {
+		t.Fatalf("expecting the callback to be called twice, got %d", len(seen))
+	}
+	for _, f := range seen {
+		if f.FullPath == "" || f.RelativePath == "" || f.Checksum == "" || f.FileSize == 0 {
+			t.Errorf("expecting a fully populated file, got %+v", f)
+		}
+	}
+
+	if len(files) != 1 || files[0].OriginalFileName != "img.png" {
+		t.Fatalf("expecting img.png to be kept, got %v", files)
+	}
+	if _, err := os.Stat(files[0].FullPath); err != nil {
+		t.Error("expecting img.png to remain:", err)
+	}
+	if _, err := os.Stat(seen[1].FullPath); !os.IsNotExist(err) {
+		t.Error("expecting notes.txt to be removed, got", err)
+	}
+}
+
+func TestTools_StrictContentType(t *testing.T) {
+	newRequest := func(t *testing.T, fileName, contentType string, content []byte) *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		header := textproto.MIMEHeader{"Content-Disposition": {fmt.Sprintf(`form-data; name="file"; filename=%q`, fileName)}}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = part.Write(content)
+		_ = writer.Close()
+
+		request := httptest.NewRequest("POST", "/", body)
+		request.Header.Add("Content-Type", writer.FormDataContentType())
+		return request
+	}
+
+	png := readTestFile(t, "img.png")
+	text := []byte("just some text pretending to be an image")
+
+	var tests = []struct {
+		name        string
+		fileName    string
+		contentType string
+		content     []byte
+		strict      bool
+		wantErr     error
+	}{
+		{name: "lying part, lenient", fileName: "fake.png", contentType: "image/png", content: text},
+		{name: "lying part, strict", fileName: "fake.png", contentType: "image/png", content: text, strict: true, wantErr: ErrContentTypeMismatch},
+		{name: "missing type, strict", fileName: "img.png", content: png, strict: true, wantErr: ErrContentTypeMismatch},
+		{name: "declared type not allowed, strict", fileName: "notes.txt", contentType: "text/plain; charset=utf-16", content: text, strict: true, wantErr: ErrFileTypeNotPermitted},
+		{name: "declared type without parameters, strict", fileName: "notes.txt", contentType: "text/plain", content: text, strict: true},
+		{name: "consistent png, strict", fileName: "img.png", contentType: "image/png", content: png, strict: true},
+		{name: "consistent text with charset, strict", fileName: "notes.txt", contentType: "text/plain; charset=utf-8", content: text, strict: true},
+	}
+
+	for _, e := range tests {
+		for _, parsed := range []bool{false, true} {
+			testTools := Tools{AllowedFileTypes: []string{"image/*", "text/plain; charset=utf-8"}, StrictContentType: e.strict}
+
+			request := newRequest(t, e.fileName, e.contentType, e.content)
+			if parsed {
+				if err := request.ParseMultipartForm(1 << 20); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := testTools.UploadFiles(request, t.TempDir())
+			if e.wantErr == nil && err != nil {
+				t.Errorf("%s (parsed %v): not expecting an error, got %v", e.name, parsed, err)
+			}
+			if e.wantErr != nil && !errors.Is(err, e.wantErr) {
+				t.Errorf("%s (parsed %v): expecting %v, got %v", e.name, parsed, e.wantErr, err)
+			}
+			if e.wantErr == ErrContentTypeMismatch && e.contentType != "" && (err == nil || !strings.Contains(err.Error(), e.contentType) || !strings.Contains(err.Error(), "text/plain")) {
+				t.Errorf("%s: expecting the error to state both types, got %v", e.name, err)
+			}
+		}
+	}
+}
+
+func TestTools_FileNameValidator(t *testing.T) {
+	validName := regexp.MustCompile(`^[a-z0-9._-]{1,100}$`)
+	errUppercase := errors.New("the name must be lowercase")
+
+	var validated []string
+	testTools := Tools{
+		AllowedFileTypes:      []string{"image/png"},
+		ContinueOnUploadError: true,
+		FileNameValidator: func(name string) error {
+			validated = append(validated, name)
+			if !validName.MatchString(name) {
+				return errUppercase
+			}
+			return nil
+		},
+	}
+
+	png := readTestFile(t, "img.png")
+	uploadDir := t.TempDir()
+	files, err := testTools.UploadFiles(newUploadRequest(t,
+		testUploadPart{"file", `photos\my-photo.png`, png},
+		testUploadPart{"file", "Photo.png", png},
+	), uploadDir, false)
+
+	var uploadErrs UploadErrors
+	if !errors.As(err, &uploadErrs) || len(uploadErrs) != 1 {
+		t.Fatalf("expecting one upload error, got %v", err)
+	}
+	if !errors.Is(uploadErrs[0], errUppercase) || !errors.Is(uploadErrs[0], ErrInvalidFileName) || uploadErrs[0].Reason != UploadErrorInvalidName {
+		t.Errorf("expecting the validator error as an invalid name, got %v", uploadErrs[0])
+	}
+	if len(files) != 1 || files[0].NewFileName != "my-photo.png" {
+		t.Fatalf("expecting my-photo.png to be saved, got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "Photo.png")); !os.IsNotExist(err) {
+		t.Error("expecting Photo.png not to be written, got", err)
+	}
+
+	// the validator sees the sanitized name
+	if len(validated) != 2 || validated[0] != "my-photo.png" {
+		t.Errorf("expecting the sanitized names to be validated, got %v", validated)
+	}
+
+	// renamed files are not validated
+	validated = nil
+	_, err = testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "Photo.png", png}), uploadDir)
+	if err != nil || len(validated) != 0 {
+		t.Errorf("expecting renamed files to skip the validator, got %v and %v", err, validated)
+	}
+}
+
+func TestTools_ValidateFiles(t *testing.T) {
+	for _, concurrency := range []int{1, 2} {
+		for _, parsed := range []bool{false, true} {
+			uploadDir := t.TempDir()
+			called := false
+			testTools := Tools{
+				AllowedFileTypes:  []string{"image/png"},
+				MaxFileSize:       1 << 20,
+				UploadConcurrency: concurrency,
+				Storage:           &LocalStorage{Dir: uploadDir},
+				OnFileUploaded: func(f *UploadedFile) error {
+					called = true
+					return nil
+				},
+			}
+
+			request := newUploadRequest(t,
+				testUploadPart{"photo", "img.png", readTestFile(t, "img.png")},
+				testUploadPart{"notes", "notes.txt", []byte("not an image")},
+			)
+			if parsed {
+				if err := request.ParseMultipartForm(1 << 20); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			results, err := testTools.ValidateFiles(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != 2 {
+				t.Fatalf("expecting 2 results, got %d", len(results))
+			}
+			accepted, rejected := results[0], results[1]
+			if parsed {
+				// the fields of a parsed form are sorted by name
+				accepted, rejected = results[1], results[0]
+			}
+			if !accepted.Accepted || accepted.FileName != "img.png" || accepted.FieldName != "photo" || accepted.ContentType != "image/png" || accepted.FileSize != int64(len(readTestFile(t, "img.png"))) {
+				t.Errorf("expecting img.png to be accepted, got %+v", accepted)
+			}
+			if rejected.Accepted || rejected.FileName != "notes.txt" || rejected.Reason != UploadErrorTypeNotPermitted || !errors.Is(rejected.Err, ErrFileTypeNotPermitted) {
+				t.Errorf("expecting notes.txt to be rejected for its type, got %+v", rejected)
+			}
+
+			entries, err := os.ReadDir(uploadDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("expecting nothing to be written, got %d entries", len(entries))
+			}
+			if called {
+				t.Error("expecting OnFileUploaded not to be called")
+			}
+		}
+	}
+
+	// results encode to JSON with the error message
+	data, err := json.Marshal(UploadValidationResult{FileName: "notes.txt", Reason: UploadErrorTypeNotPermitted, Err: ErrFileTypeNotPermitted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"file_name":"notes.txt","field_name":"","content_type":"","file_size":0,"accepted":false,"reason":1,"error":"the uploaded file type is not permitted"}`
+	if string(data) != want {
+		t.Errorf("expecting %s, got %s", want, data)
+	}
+
+	testTools := Tools{AllowedFileTypes: []string{"image/png"}}
+	_, err = testTools.ValidateFiles(newUploadRequest(t))
+	if !errors.Is(err, ErrNoFileProvided) {
+		t.Errorf("expecting ErrNoFileProvided, got %v", err)
+	}
+}
+
+func TestTools_MaxFileSizeByType(t *testing.T) {
+	png := readTestFile(t, "img.png")
+	pdf := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte("0"), 2*len(png))...)
+	pdf = append(pdf, []byte("\n%%EOF\n")...)
+
+	newTools := func() *Tools {
+		return &Tools{
+			AllowedFileTypes: []string{"image/png", "application/pdf"},
+			MaxFileSize:      int64(len(png)) + 100,
+			MaxFileSizeByType: map[string]int64{
+				"image/*":         int64(len(png)) - 1,
+				"application/pdf": int64(len(pdf)),
+			},
+		}
+	}
+
+	for _, parsed := range []bool{false, true} {
+		newRequest := func(part testUploadPart) *http.Request {
+			request := newUploadRequest(t, part)
+			if parsed {
+				if err := request.ParseMultipartForm(1 << 20); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return request
+		}
+
+		// the image is under MaxFileSize but over the image/* limit
+		_, err := newTools().UploadFiles(newRequest(testUploadPart{"file", "img.png", png}), t.TempDir())
+		if !errors.Is(err, ErrFileTooBig) || !strings.Contains(err.Error(), "image/*") {
+			t.Errorf("parsed %v: expecting the image/* limit to reject img.png, got %v", parsed, err)
+		}
+
+		// the pdf is over MaxFileSize but under the application/pdf limit
+		files, err := newTools().UploadFiles(newRequest(testUploadPart{"file", "doc.pdf", pdf}), t.TempDir())
+		if err != nil {
+			t.Errorf("parsed %v: expecting the application/pdf limit to accept doc.pdf, got %v", parsed, err)
+		} else if files[0].FileSize != int64(len(pdf)) {
+			t.Errorf("parsed %v: expecting %d bytes, got %d", parsed, len(pdf), files[0].FileSize)
+		}
+	}
+
+	// types without an entry fall back to MaxFileSize
+	testTools := newTools()
+	testTools.AllowedFileTypes = []string{"text/plain; charset=utf-8"}
+	_, err := testTools.UploadFiles(newUploadRequest(t, testUploadPart{"file", "notes.txt", bytes.Repeat([]byte("a"), len(png)+101)}), t.TempDir())
+	if !errors.Is(err, ErrFileTooBig) || !strings.Contains(err.Error(), "MaxFileSize limit") {
+		t.Errorf("expecting MaxFileSize to reject notes.txt, got %v", err)
+	}
+
+	// an exact type wins over a wildcard
+	testTools.MaxFileSizeByType = map[string]int64{"image/*": 10, "image/png": 20, "image/p*": 30}
+	if limit, pattern := testTools.fileSizeLimit("image/png"); limit != 20 || pattern != "image/png" {
+		t.Errorf("expecting the image/png limit, got %d from %q", limit, pattern)
+	}
+	if limit, pattern := testTools.fileSizeLimit("image/pjpeg"); limit != 30 || pattern != "image/p*" {
+		t.Errorf("expecting the image/p* limit, got %d from %q", limit, pattern)
+	}
+}
+
+func TestTools_UploadDirFunc(t *testing.T) {
+	type userKey struct{}
+	root := t.TempDir()
+	errNoUser := errors.New("no authenticated user")
+
+	testTools := Tools{
+		AllowedFileTypes:      []string{"image/png", "application/pdf"},
+		ContinueOnUploadError: true,
+		PublicBaseURL:         "https://cdn.example.com/uploads",
+		UploadDirFunc: func(r *http.Request, fieldName, detectedType string) (string, error) {
+			user, ok := r.Context().Value(userKey{}).(string)
+			if !ok {
+				return "", errNoUser
+			}
+			kind := "documents"
+			if strings.HasPrefix(detectedType, "image/") {
+				kind = "images"
+			}
+			return filepath.Join(root, user, kind), nil
+		},
+	}
+
+	pdf := []byte("%PDF-1.4\n%%EOF\n")
+	newRequest := func() *http.Request {
+		return newUploadRequest(t,
+			testUploadPart{"file", "img.png", readTestFile(t, "img.png")},
+			testUploadPart{"file", "doc.pdf", pdf},
+		)
+	}
+
+	request := newRequest()
+	request = request.WithContext(context.WithValue(request.Context(), userKey{}, "alice"))
+	uploadDir := t.TempDir()
+	files, err := testTools.UploadFiles(request, uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(root, "alice", "images"), filepath.Join(root, "alice", "documents")}
+	for i, f := range files {
+		if f.UploadDir != want[i] || f.FullPath != filepath.Join(want[i], f.RelativePath) {
+			t.Errorf("expecting %s to be saved in %s, got %s", f.OriginalFileName, want[i], f.FullPath)
+		}
+		// PublicBaseURL serves the upload directory only
+		if f.URL != "" {
+			t.Errorf("expecting no URL for %s, got %s", f.OriginalFileName, f.URL)
+		}
+		if _, err := os.Stat(f.FullPath); err != nil {
+			t.Error(err)
+		}
+	}
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 0 {
+		t.Errorf("expecting the upload directory to stay empty, got %d entries", len(entries))
+	}
+
+	// an error rejects the file
+	_, err = testTools.UploadFiles(newRequest(), uploadDir)
+	var uploadErrs UploadErrors
+	if !errors.As(err, &uploadErrs) || len(uploadErrs) != 2 || !errors.Is(uploadErrs[0], errNoUser) {
+		t.Errorf("expecting both files to be rejected, got %v", err)
+	}
+
+	// without the callback the upload directory is used
+	testTools.UploadDirFunc = nil
+	files, err = testTools.UploadFiles(newRequest(), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].UploadDir != uploadDir || files[0].URL == "" {
+		t.Errorf("expecting %s with a URL, got %s and %q", uploadDir, files[0].UploadDir, files[0].URL)
+	}
+}